@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiTimeout is the timeout of a Zabbix API request
+const apiTimeout = 10 * time.Second
+
+// Environment variables read when -api-token or -api-password are not given,
+// so that the secrets do not show in the process list
+const (
+	APITokenEnv    = "ZABBIX_API_TOKEN"
+	APIPasswordEnv = "ZABBIX_API_PASSWORD"
+)
+
+// Zabbix API constants of the host objects
+const (
+	apiAgentInterface = 1
+	apiTLSNone        = 1
+	apiTLSPSK         = 2
+	apiTLSCert        = 4
+)
+
+// macroRegexp matches a user macro like {$ENV} or {$ENV:context}
+var macroRegexp = regexp.MustCompile(`^\{\$[A-Z0-9_.]+(:.*)?\}$`)
+
+// ZabbixAPI is a client of the Zabbix JSON-RPC API.
+type ZabbixAPI struct {
+	URL     string
+	Token   string
+	Version string
+	Client  *http.Client
+	id      int
+}
+
+type apiRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+	Auth    string      `json:"auth,omitempty"`
+	ID      int         `json:"id"`
+}
+
+type apiResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *APIError       `json:"error"`
+}
+
+// APIError is an error returned by the Zabbix API.
+type APIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    string `json:"data"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("zabbix api error %d: %s %s", e.Code, e.Message, e.Data)
+}
+
+// HostInfo is the host registered in Zabbix.
+type HostInfo struct {
+	HostID  string `json:"hostid"`
+	Host    string `json:"host"`
+	Created bool   `json:"created"`
+}
+
+// NewZabbixAPI returns a client of the API at apiURL.
+func NewZabbixAPI(apiURL string, token string) *ZabbixAPI {
+	return &ZabbixAPI{URL: apiURL, Token: token, Client: &http.Client{Timeout: apiTimeout}}
+}
+
+// versionAtLeast returns true if the API version is major.minor or later
+func (api *ZabbixAPI) versionAtLeast(major int, minor int) bool {
+	parts := strings.SplitN(api.Version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	m, _ := strconv.Atoi(parts[0])
+	n, _ := strconv.Atoi(parts[1])
+	return m > major || m == major && n >= minor
+}
+
+// Call calls the API method and decodes its result into result.
+// The token is sent in the Authorization header since Zabbix 6.4, in the auth field before.
+func (api *ZabbixAPI) Call(method string, params interface{}, result interface{}) error {
+	api.id++
+	request := apiRequest{JSONRPC: "2.0", Method: method, Params: params, ID: api.id}
+	authenticated := api.Token != "" && method != "apiinfo.version" && method != "user.login"
+	bearer := api.versionAtLeast(6, 4)
+	if authenticated && !bearer {
+		request.Auth = api.Token
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, api.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json-rpc")
+	if authenticated && bearer {
+		req.Header.Set("Authorization", "Bearer "+api.Token)
+	}
+	resp, err := api.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("zabbix api %s: %s", method, resp.Status)
+	}
+	var response apiResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return fmt.Errorf("zabbix api %s: %s", method, err.Error())
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+// Login reads the API version and logs in with the user and the password if there is no token.
+func (api *ZabbixAPI) Login(user string, password string) error {
+	err := api.Call("apiinfo.version", []string{}, &api.Version)
+	if err != nil {
+		return err
+	}
+	if api.Token != "" {
+		return nil
+	}
+	// user was renamed to username in Zabbix 5.4
+	userKey := "user"
+	if api.versionAtLeast(5, 4) {
+		userKey = "username"
+	}
+	return api.Call("user.login", map[string]string{userKey: user, "password": password}, &api.Token)
+}
+
+// Logout ends the session opened by Login.
+func (api *ZabbixAPI) Logout() error {
+	return api.Call("user.logout", []string{}, nil)
+}
+
+// lookupIDs returns the ids of the objects named names, every name must exist
+func (api *ZabbixAPI) lookupIDs(method string, nameKey string, idKey string, names []string) ([]string, error) {
+	if len(names) == 0 {
+		// an empty filter matches every object
+		return nil, nil
+	}
+	var objects []map[string]string
+	err := api.Call(method, map[string]interface{}{
+		"output": []string{idKey, nameKey},
+		"filter": map[string][]string{nameKey: names},
+	}, &objects)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]string)
+	for _, object := range objects {
+		ids[object[nameKey]] = object[idKey]
+	}
+	var result []string
+	for _, name := range names {
+		id, ok := ids[name]
+		if !ok {
+			return nil, fmt.Errorf("zabbix %s not found: %s", strings.TrimSuffix(method, ".get"), name)
+		}
+		result = append(result, id)
+	}
+	return result, nil
+}
+
+// apiHost is the part of a host read from the API
+type apiHost struct {
+	HostID     string `json:"hostid"`
+	Host       string `json:"host"`
+	Interfaces []struct {
+		InterfaceID string `json:"interfaceid"`
+		Type        string `json:"type"`
+		Main        string `json:"main"`
+	} `json:"interfaces"`
+	Groups          []map[string]string `json:"groups"`
+	HostGroups      []map[string]string `json:"hostgroups"`
+	ParentTemplates []map[string]string `json:"parentTemplates"`
+	Macros          []map[string]string `json:"macros"`
+}
+
+// RegisterHost creates the host of the agent in Zabbix, or updates it if it exists.
+// Host groups, templates and macros are added to those of an existing host, the main
+// agent interface is updated in place and the other interfaces are kept.
+func RegisterHost(api *ZabbixAPI, config *Config, tls *TLSInfo) (*HostInfo, error) {
+	groupIDs, err := api.lookupIDs("hostgroup.get", "name", "groupid", config.HostGroups)
+	if err != nil {
+		return nil, err
+	}
+	templateIDs, err := api.lookupIDs("template.get", "host", "templateid", config.Templates)
+	if err != nil {
+		return nil, err
+	}
+	// selectGroups was renamed to selectHostGroups in Zabbix 6.2
+	selectGroups := "selectGroups"
+	if api.versionAtLeast(6, 2) {
+		selectGroups = "selectHostGroups"
+	}
+	var hosts []apiHost
+	err = api.Call("host.get", map[string]interface{}{
+		"output":                []string{"hostid", "host"},
+		"filter":                map[string][]string{"host": {config.Hostname}},
+		"selectInterfaces":      []string{"interfaceid", "type", "main"},
+		selectGroups:            []string{"groupid"},
+		"selectParentTemplates": []string{"templateid"},
+		"selectMacros":          []string{"hostmacroid", "macro"},
+	}, &hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	params := map[string]interface{}{}
+	params["tls_connect"], params["tls_accept"] = apiTLSNone, apiTLSNone
+	if tls != nil {
+		switch tls.Mode {
+		case TLSPSK:
+			params["tls_connect"], params["tls_accept"] = apiTLSPSK, apiTLSPSK
+			params["tls_psk_identity"], params["tls_psk"] = tls.PSKIdentity, tls.PSK
+		case TLSCert:
+			params["tls_connect"], params["tls_accept"] = apiTLSCert, apiTLSCert
+		}
+	}
+	iface := agentInterface(config)
+	macros, err := ParseMacros(config.Macros)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hosts) == 0 {
+		params["host"] = config.Hostname
+		params["interfaces"] = []map[string]interface{}{iface}
+		params["groups"] = idObjects("groupid", groupIDs)
+		params["templates"] = idObjects("templateid", templateIDs)
+		params["macros"] = hostMacros(nil, macros)
+		var created struct {
+			HostIDs []string `json:"hostids"`
+		}
+		err = api.Call("host.create", params, &created)
+		if err != nil {
+			return nil, err
+		}
+		if len(created.HostIDs) == 0 {
+			return nil, fmt.Errorf("zabbix api host.create returned no host")
+		}
+		return &HostInfo{HostID: created.HostIDs[0], Host: config.Hostname, Created: true}, nil
+	}
+
+	host := hosts[0]
+	params["hostid"] = host.HostID
+	params["groups"] = idObjects("groupid", mergeIDs(host.Groups, host.HostGroups, "groupid", groupIDs))
+	params["templates"] = idObjects("templateid", mergeIDs(host.ParentTemplates, nil, "templateid", templateIDs))
+	params["macros"] = hostMacros(host.Macros, macros)
+	err = api.Call("host.update", params, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range host.Interfaces {
+		if i.Type == strconv.Itoa(apiAgentInterface) && i.Main == "1" {
+			iface["interfaceid"] = i.InterfaceID
+			return &HostInfo{HostID: host.HostID, Host: host.Host}, api.Call("hostinterface.update", iface, nil)
+		}
+	}
+	iface["hostid"] = host.HostID
+	return &HostInfo{HostID: host.HostID, Host: host.Host}, api.Call("hostinterface.create", iface, nil)
+}
+
+// agentInterface returns the agent interface of the host, connected by ip or by DNS name
+func agentInterface(config *Config) map[string]interface{} {
+	iface := map[string]interface{}{"type": apiAgentInterface, "main": 1, "useip": 1, "ip": "", "dns": "", "port": config.ListenPort}
+	if ip := net.ParseIP(TrimBrackets(config.AgentIP)); ip != nil {
+		iface["ip"] = ip.String()
+	} else {
+		iface["useip"], iface["dns"] = 0, config.AgentIP
+	}
+	return iface
+}
+
+// idObjects returns the ids as API objects like {"groupid": "2"}
+func idObjects(key string, ids []string) []map[string]string {
+	objects := []map[string]string{}
+	for _, id := range ids {
+		objects = append(objects, map[string]string{key: id})
+	}
+	return objects
+}
+
+// mergeIDs returns the ids of the objects followed by the new ids, without duplicates
+func mergeIDs(objects []map[string]string, moreObjects []map[string]string, key string, ids []string) []string {
+	var all []string
+	for _, object := range append(objects, moreObjects...) {
+		all = append(all, object[key])
+	}
+	var merged []string
+	seen := make(map[string]bool)
+	for _, id := range append(all, ids...) {
+		if !seen[id] {
+			seen[id] = true
+			merged = append(merged, id)
+		}
+	}
+	return merged
+}
+
+// hostMacros returns the existing macros of a host with the values of macros, followed by
+// the new macros. Existing macros are kept by their id, so secret values are not lost.
+func hostMacros(existing []map[string]string, macros map[string]string) []map[string]string {
+	apiMacros := []map[string]string{}
+	seen := make(map[string]bool)
+	for _, macro := range existing {
+		apiMacro := map[string]string{"hostmacroid": macro["hostmacroid"]}
+		if value, ok := macros[macro["macro"]]; ok {
+			apiMacro["value"] = value
+			seen[macro["macro"]] = true
+		}
+		apiMacros = append(apiMacros, apiMacro)
+	}
+	var names []string
+	for name := range macros {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		apiMacros = append(apiMacros, map[string]string{"macro": name, "value": macros[name]})
+	}
+	return apiMacros
+}
+
+// ParseMacros parses the -macro options, a name without {$ } is wrapped in it.
+func ParseMacros(macros []string) (map[string]string, error) {
+	m := make(map[string]string, len(macros))
+	for _, macro := range macros {
+		name, value, ok := strings.Cut(macro, "=")
+		name = strings.TrimSpace(name)
+		if !strings.HasPrefix(name, "{$") {
+			name = "{$" + name + "}"
+		}
+		if !ok || !macroRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid -macro %s, use {$NAME}=value", macro)
+		}
+		m[name] = value
+	}
+	return m, nil
+}
+
+// apiHandler processes the Zabbix API options, the secrets may come from the environment
+func apiHandler(config *Config) error {
+	if config.APIURL == "" {
+		return nil
+	}
+	u, err := url.Parse(config.APIURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid -api-url %s, like https://zabbix.example.com/api_jsonrpc.php", config.APIURL)
+	}
+	if config.APIToken == "" {
+		config.APIToken = os.Getenv(APITokenEnv)
+	}
+	if config.APIPassword == "" {
+		config.APIPassword = os.Getenv(APIPasswordEnv)
+	}
+	if config.APIToken == "" && (config.APIUser == "" || config.APIPassword == "") {
+		return fmt.Errorf("-api-url needs -api-token or -api-user and -api-password")
+	}
+	if len(config.HostGroups) == 0 {
+		return fmt.Errorf("-api-url needs -host-groups")
+	}
+	_, err = ParseMacros(config.Macros)
+	return err
+}
+
+// registerHost registers the host of the agent through the Zabbix API
+func registerHost(config *Config, pathConfig *PathConfig) (*HostInfo, error) {
+	api := NewZabbixAPI(config.APIURL, config.APIToken)
+	err := api.Login(config.APIUser, config.APIPassword)
+	if err != nil {
+		return nil, err
+	}
+	if config.APIToken == "" {
+		defer api.Logout()
+	}
+	return RegisterHost(api, config, NewTLSInfo(config, pathConfig))
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"zabbix_agent_installer/utils"
+)
+
+// backupDirName is the directory of the backups in AgentDir
+const backupDirName = "zabbix_agent_installer_backups"
+
+// backupInfoName is the metadata file at the top of a backup archive
+const backupInfoName = "backup.json"
+
+// LatestBackup selects the most recent backup of the instance for restore.
+const LatestBackup = "latest"
+
+// BackupInfo describes a backup of an agent directory.
+type BackupInfo struct {
+	Name       string      `json:"name"`
+	Path       string      `json:"path,omitempty"`
+	Size       int64       `json:"size,omitempty"`
+	Instance   string      `json:"instance,omitempty"`
+	Version    string      `json:"version"`
+	Time       time.Time   `json:"time"`
+	Logs       bool        `json:"logs"`
+	Config     *Config     `json:"config"`
+	PathConfig *PathConfig `json:"path_config"`
+}
+
+// backupDir returns the directory of the backups
+func backupDir(config *Config) string {
+	return filepath.Join(config.AgentDir, backupDirName)
+}
+
+// backup archives the agent installed in AgentDir, or each selected instance, or lists the backups with -list
+func backup(config *Config, result *Result) error {
+	if config.ListBackups {
+		err := resolveInstalledConfig(config)
+		if err != nil {
+			return err
+		}
+		backups, err := ListBackups(backupDir(config))
+		if err != nil {
+			return NewError(FilesystemError, err)
+		}
+		result.Backups = backups
+		PrintBackups(textOutput(config), backups)
+		return nil
+	}
+	configs, err := installedConfigs(config)
+	if err != nil {
+		return err
+	}
+	for _, instanceConfig := range configs {
+		var pathConfig = &PathConfig{}
+		err = locateAgent(instanceConfig, pathConfig)
+		if err != nil {
+			return err
+		}
+		err = result.Step(stepName(instanceConfig, "create backup"), func() error {
+			info, err := CreateBackup(instanceConfig, pathConfig, backupDir(config))
+			if info != nil {
+				result.Backups = append(result.Backups, info)
+			}
+			return NewError(FilesystemError, err)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateBackup archives the agent directory into a tar.gz in dir, with backup.json at its top.
+// The pid file, and the log files unless BackupLogs is set, are left out.
+func CreateBackup(config *Config, pathConfig *PathConfig, dir string) (*BackupInfo, error) {
+	version, err := GetAgentVersion(pathConfig.ZabbixAgentBinAbsPath)
+	if err != nil {
+		utils.Warn("read agent version failed", "error", err)
+	}
+	backupConfig := *config
+	if conf, err := ReadAgentConf(pathConfig.ZabbixAgentConfAbsPath); err == nil {
+		backupConfig.ServerIP, backupConfig.ServerPort = agentServer(config, conf)
+		backupConfig.Hostname, _ = conf.Get("Hostname")
+		backupConfig.ListenPort = DefaultListenPort
+		if port, ok := conf.Get("ListenPort"); ok {
+			backupConfig.ListenPort = port
+		}
+	}
+	now := time.Now()
+	dirName := filepath.Base(pathConfig.ZabbixAgentDirAbsPath)
+	info := &BackupInfo{
+		Name:       dirName + "-" + now.Format("20060102-150405") + ".tar.gz",
+		Instance:   config.Instance,
+		Version:    version,
+		Time:       now,
+		Logs:       config.BackupLogs,
+		Config:     &backupConfig,
+		PathConfig: pathConfig,
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	// The archive is written aside so that an unfinished backup is never listed
+	tempFile, err := os.CreateTemp(dir, ".backup-")
+	if err != nil {
+		return nil, err
+	}
+	tempFile.Close()
+	defer os.Remove(tempFile.Name())
+	w, err := utils.CreateTarGz(tempFile.Name())
+	if err != nil {
+		return nil, err
+	}
+	err = w.AddBytes(backupInfoName, data, 0600)
+	if err == nil {
+		err = w.AddTree(pathConfig.ZabbixAgentDirAbsPath, dirName, func(rel string) bool {
+			name := filepath.Base(rel)
+			if strings.HasSuffix(name, ".pid") {
+				return true
+			}
+			return !config.BackupLogs && (strings.HasSuffix(name, ".log") || strings.Contains(name, ".log."))
+		})
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Path = filepath.Join(dir, info.Name)
+	err = os.Rename(tempFile.Name(), info.Path)
+	if err != nil {
+		return nil, err
+	}
+	if fileInfo, err := os.Stat(info.Path); err == nil {
+		info.Size = fileInfo.Size()
+	}
+	utils.Info("create backup successfully", "backup", info.Path, "version", info.Version)
+	return info, nil
+}
+
+// ReadBackupInfo reads the metadata of the backup archive.
+func ReadBackupInfo(backupAbsPath string) (*BackupInfo, error) {
+	data, err := utils.ReadTarGzFile(backupAbsPath, backupInfoName)
+	if err != nil {
+		return nil, err
+	}
+	info := &BackupInfo{}
+	err = json.Unmarshal(data, info)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s in %s: %s", backupInfoName, backupAbsPath, err.Error())
+	}
+	if info.Config == nil || info.PathConfig == nil {
+		return nil, fmt.Errorf("invalid %s in %s", backupInfoName, backupAbsPath)
+	}
+	info.Path = backupAbsPath
+	if fileInfo, err := os.Stat(backupAbsPath); err == nil {
+		info.Size = fileInfo.Size()
+	}
+	return info, nil
+}
+
+// ListBackups returns the backups in dir from the oldest to the newest, unreadable archives are skipped.
+func ListBackups(dir string) ([]*BackupInfo, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tar.gz"))
+	if err != nil {
+		return nil, err
+	}
+	backups := []*BackupInfo{}
+	for _, file := range files {
+		info, err := ReadBackupInfo(file)
+		if err != nil {
+			utils.Warn("skip backup", "backup", file, "error", err)
+			continue
+		}
+		backups = append(backups, info)
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Time.Before(backups[j].Time)
+	})
+	return backups, nil
+}
+
+// FindBackup returns the backup named name in dir, a path, or the latest backup of the instance.
+func FindBackup(dir string, name string, instance string) (*BackupInfo, error) {
+	if name == LatestBackup {
+		backups, err := ListBackups(dir)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(backups) - 1; i >= 0; i-- {
+			if backups[i].Instance == instance {
+				return backups[i], nil
+			}
+		}
+		return nil, fmt.Errorf("no backup in %s", dir)
+	}
+	backupAbsPath := name
+	if !strings.ContainsRune(name, filepath.Separator) && !strings.ContainsRune(name, '/') {
+		backupAbsPath = filepath.Join(dir, name)
+		if !strings.HasSuffix(backupAbsPath, ".tar.gz") {
+			backupAbsPath += ".tar.gz"
+		}
+	}
+	if IsFileNotExist(backupAbsPath) {
+		return nil, fmt.Errorf("backup not found: %s", backupAbsPath)
+	}
+	return ReadBackupInfo(backupAbsPath)
+}
+
+// PrintBackups prints the backups as a table.
+func PrintBackups(w io.Writer, backups []*BackupInfo) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tINSTANCE\tVERSION\tTIME\tSIZE")
+	for _, info := range backups {
+		instance := info.Instance
+		if instance == "" {
+			instance = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n", info.Name, instance, info.Version, info.Time.Format(time.RFC3339), info.Size)
+	}
+	tw.Flush()
+}
+
+// restore replaces the agent with a backup and registers its service again
+func restore(config *Config, result *Result) error {
+	err := resolveInstalledConfig(config)
+	if err != nil {
+		return err
+	}
+	if config.BackupName == "" {
+		return Errorf(ValidationError, "use -backup <name> or -backup latest, backup -list lists the backups")
+	}
+	if len(config.Instances) > 1 || len(config.Instances) == 1 && config.Instances[0] == AllInstances {
+		return Errorf(ValidationError, "restore restores one instance at a time")
+	}
+	if len(config.Instances) == 1 {
+		config.Instance = config.Instances[0]
+	}
+	var info *BackupInfo
+	err = result.Step("read backup", func() error {
+		info, err = FindBackup(backupDir(config), config.BackupName, config.Instance)
+		return NewError(FilesystemError, err)
+	})
+	if err != nil {
+		return err
+	}
+	result.Backups = []*BackupInfo{info}
+	// The configuration holds absolute paths in the directory the agent was installed in
+	if !IsSamePath(config.AgentDir, info.Config.AgentDir) {
+		return Errorf(ValidationError, "backup %s was made in %s, restore it with -d %s", info.Name, info.Config.AgentDir, info.Config.AgentDir)
+	}
+	// The agent is restored in AgentDir with the settings it was installed with
+	restoreConfig := *info.Config
+	restoreConfig.AgentDir, restoreConfig.OSType, restoreConfig.OSArch = config.AgentDir, config.OSType, config.OSArch
+	restoreConfig.AutoPort, restoreConfig.Output = config.AutoPort, config.Output
+	config = &restoreConfig
+	var pathConfig = &PathConfig{}
+	SetAgentPaths(config, pathConfig)
+	if !IsFileNotExist(pathConfig.ZabbixAgentBinAbsPath) {
+		err = result.Step(stepName(config, "stop agent"), func() error {
+			return NewError(ServiceError, stopAgent(config, pathConfig))
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		result.Skip(stepName(config, "stop agent"))
+	}
+	err = result.Step(stepName(config, "restore files"), func() error {
+		return NewError(FilesystemError, RestoreBackupFiles(info, config, pathConfig))
+	})
+	if err != nil {
+		return err
+	}
+	utils.Info("restore files successfully", "backup", info.Path, "dir", pathConfig.ZabbixAgentDirAbsPath)
+	if IsOtherUser(config.AgentUser) {
+		err = result.Step(stepName(config, "change owner"), func() error {
+			return NewError(FilesystemError, ChownR(pathConfig.ZabbixAgentDirAbsPath, config.AgentUser))
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		result.Skip(stepName(config, "change owner"))
+	}
+	if conf, err := ReadAgentConf(pathConfig.ZabbixAgentConfAbsPath); err == nil {
+		config.ListenPort = DefaultListenPort
+		if port, ok := conf.Get("ListenPort"); ok {
+			config.ListenPort = port
+		}
+	}
+	err = result.Step(stepName(config, "start agent"), func() error {
+		return NewError(ServiceError, startAgent(config, pathConfig))
+	})
+	result.AddAgent(config, pathConfig, agentPids(pathConfig.ZabbixAgentBinAbsPath), agentServiceInfo(config, pathConfig), nil)
+	if err != nil {
+		return err
+	}
+	utils.Info("restore zabbix agent successfully", "backup", info.Name, "version", info.Version)
+	return nil
+}
+
+// RestoreBackupFiles replaces the agent directory with the files of the backup.
+// The current directory is moved aside and put back if the backup cannot be unpacked.
+func RestoreBackupFiles(info *BackupInfo, config *Config, pathConfig *PathConfig) error {
+	stagingDir, err := os.MkdirTemp(config.AgentDir, ".unpack-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+	err = utils.UnpackingFile(info.Path, stagingDir)
+	if err != nil {
+		return err
+	}
+	srcDir := filepath.Join(stagingDir, filepath.Base(info.PathConfig.ZabbixAgentDirAbsPath))
+	if IsFileNotExist(srcDir) {
+		return fmt.Errorf("no agent directory in %s", info.Path)
+	}
+	asideDir, err := os.MkdirTemp(config.AgentDir, ".restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(asideDir)
+	oldDir := filepath.Join(asideDir, "agent")
+	installed := !IsFileNotExist(pathConfig.ZabbixAgentDirAbsPath)
+	if installed {
+		err = os.Rename(pathConfig.ZabbixAgentDirAbsPath, oldDir)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Rename(srcDir, pathConfig.ZabbixAgentDirAbsPath)
+	if err != nil && installed {
+		if rollbackErr := os.Rename(oldDir, pathConfig.ZabbixAgentDirAbsPath); rollbackErr != nil {
+			utils.Error("put back the agent directory failed", "dir", oldDir, "error", rollbackErr)
+		}
+	}
+	return err
+}
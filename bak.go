@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"regexp"
 	"runtime"
+	"zabbix_agent_installer/utils"
 )
 
 // GetZabbixAgentLink returns the zabbix agent link
@@ -27,7 +28,7 @@ func GetZabbixAgentLink(links []string) string {
 			if IsContainsOr(links[i], []string{"amd64"}) && IsContainsAnd(zaLinks[i], []string{"win"}) {
 				avaLinks = append(avaLinks, zaLinks[i])
 			} else {
-				Logger("ERROR", fmt.Sprintf("unknown OS arch:%s", oa))
+				utils.Error("unknown OS arch", "arch", oa)
 			}
 		}
 	case "linux":
@@ -41,11 +42,11 @@ func GetZabbixAgentLink(links []string) string {
 					avaLinks = append(avaLinks, zaLinks[i])
 				}
 			} else {
-				Logger("ERROR", fmt.Sprintf("unknown OS arch:%s", oa))
+				utils.Error("unknown OS arch", "arch", oa)
 			}
 		}
 	default:
-		Logger("ERROR", fmt.Sprintf("unknown OS type:%s", ot))
+		utils.Error("unknown OS type", "os", ot)
 	}
 	return avaLinks[len(avaLinks)-1]
 }
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// agentConfKeys are the parameters of zabbix_agentd.conf, true for those which can be repeated
+var agentConfKeys = map[string]bool{
+	"Alias": true, "AllowKey": true, "DenyKey": true, "Include": true, "LoadModule": true,
+	"PerfCounter": true, "PerfCounterEn": true, "UserParameter": true,
+	"AllowRoot": false, "BufferSend": false, "BufferSize": false, "DebugLevel": false,
+	"EnableRemoteCommands": false, "HeartbeatFrequency": false, "HostInterface": false,
+	"HostInterfaceItem": false, "HostMetadata": false, "HostMetadataItem": false, "Hostname": false,
+	"HostnameItem": false, "ListenBacklog": false, "ListenIP": false, "ListenPort": false,
+	"LoadModulePath": false, "LogFile": false, "LogFileSize": false, "LogRemoteCommands": false,
+	"LogType": false, "MaxLinesPerSecond": false, "PidFile": false, "RefreshActiveChecks": false,
+	"Server": false, "ServerActive": false, "SourceIP": false, "StartAgents": false, "Timeout": false,
+	"TLSAccept": false, "TLSCAFile": false, "TLSCertFile": false, "TLSCipherAll": false,
+	"TLSCipherAll13": false, "TLSCipherCert": false, "TLSCipherCert13": false, "TLSCipherPSK": false,
+	"TLSCipherPSK13": false, "TLSConnect": false, "TLSCRLFile": false, "TLSKeyFile": false,
+	"TLSPSKFile": false, "TLSPSKIdentity": false, "TLSServerCertIssuer": false,
+	"TLSServerCertSubject": false, "UnsafeUserParameters": false, "User": false, "UserParameterDir": false,
+}
+
+// AgentConf is a zabbix_agentd.conf file, comments and the order of the lines are kept.
+type AgentConf struct {
+	lines []confLine
+}
+
+// confLine is a line of the configuration, Key is empty for comments and blank lines.
+type confLine struct {
+	Raw   string
+	Key   string
+	Value string
+}
+
+// ParseAgentConf parses the content of a zabbix_agentd.conf file.
+func ParseAgentConf(data []byte) *AgentConf {
+	conf := &AgentConf{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		raw := strings.TrimRight(scanner.Text(), "\r")
+		conf.lines = append(conf.lines, parseConfLine(raw))
+	}
+	return conf
+}
+
+func parseConfLine(raw string) confLine {
+	line := strings.TrimSpace(raw)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return confLine{Raw: raw}
+	}
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return confLine{Raw: raw}
+	}
+	return confLine{Raw: raw, Key: strings.TrimSpace(key), Value: strings.TrimSpace(value)}
+}
+
+// ReadAgentConf reads and parses the configuration file.
+func ReadAgentConf(confAbsPath string) (*AgentConf, error) {
+	data, err := os.ReadFile(confAbsPath)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAgentConf(data), nil
+}
+
+// Get returns the last value of the key, the one used by the agent.
+func (c *AgentConf) Get(key string) (string, bool) {
+	values := c.GetAll(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[len(values)-1], true
+}
+
+// GetAll returns every value of the key, for keys such as UserParameter or Include.
+func (c *AgentConf) GetAll(key string) []string {
+	var values []string
+	for _, line := range c.lines {
+		if line.Key == key {
+			values = append(values, line.Value)
+		}
+	}
+	return values
+}
+
+// Keys returns the keys in the order of their first appearance.
+func (c *AgentConf) Keys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, line := range c.lines {
+		if line.Key != "" && !seen[line.Key] {
+			seen[line.Key] = true
+			keys = append(keys, line.Key)
+		}
+	}
+	return keys
+}
+
+// Set sets the key to the value.
+// The first line of the key is replaced and the others are removed. A missing key
+// is placed after its commented default, like "# ListenPort=10050", or appended.
+func (c *AgentConf) Set(key string, value string) {
+	c.SetAll(key, []string{value})
+}
+
+// SetAll replaces every line of the key with one line per value.
+func (c *AgentConf) SetAll(key string, values []string) {
+	var newLines []confLine
+	for _, value := range values {
+		newLines = append(newLines, confLine{Raw: key + "=" + value, Key: key, Value: value})
+	}
+	at := -1
+	var lines []confLine
+	for _, line := range c.lines {
+		if line.Key == key {
+			if at == -1 {
+				at = len(lines)
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if at == -1 {
+		at = c.commentedDefault(lines, key)
+	}
+	c.lines = append(lines[:at], append(newLines, lines[at:]...)...)
+}
+
+// Add appends a line for the key after its other lines.
+func (c *AgentConf) Add(key string, value string) {
+	values := append(c.GetAll(key), value)
+	c.SetAll(key, values)
+}
+
+// Unset removes every line of the key.
+func (c *AgentConf) Unset(key string) {
+	c.SetAll(key, nil)
+}
+
+// commentedDefault returns the index following the commented default of the key in lines,
+// or the end of lines.
+func (c *AgentConf) commentedDefault(lines []confLine, key string) int {
+	for i := len(lines) - 1; i >= 0; i-- {
+		if lines[i].Key != "" {
+			continue
+		}
+		comment := strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(lines[i].Raw), "#"))
+		if strings.HasPrefix(comment, key+"=") {
+			return i + 1
+		}
+	}
+	return len(lines)
+}
+
+// Bytes returns the content of the configuration file.
+func (c *AgentConf) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, line := range c.lines {
+		buf.WriteString(line.Raw)
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+// WriteFile writes the configuration through a temp file,
+// keeping the mode and the owner of an existing file.
+func (c *AgentConf) WriteFile(confAbsPath string) error {
+	var perm os.FileMode = 0644
+	fileInfo, statErr := os.Stat(confAbsPath)
+	if statErr == nil {
+		perm = fileInfo.Mode().Perm()
+	}
+	tempFileAbsPath := filepath.Join(filepath.Dir(confAbsPath), "."+filepath.Base(confAbsPath)+RandStringBytes(6))
+	err := os.WriteFile(tempFileAbsPath, c.Bytes(), perm)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tempFileAbsPath, perm)
+	if err == nil && statErr == nil {
+		err = CopyOwner(fileInfo, tempFileAbsPath)
+	}
+	if err != nil {
+		os.Remove(tempFileAbsPath)
+		return err
+	}
+	return os.Rename(tempFileAbsPath, confAbsPath)
+}
+
+// Validate checks the configuration the way the agent reads it: every line is a comment
+// or a known Key=Value, and only keys like UserParameter are repeated.
+func (c *AgentConf) Validate() error {
+	var problems []string
+	seen := make(map[string]bool)
+	for i, line := range c.lines {
+		if line.Key == "" {
+			trimmed := strings.TrimSpace(line.Raw)
+			if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+				problems = append(problems, fmt.Sprintf("line %d: not Key=Value: %s", i+1, trimmed))
+			}
+			continue
+		}
+		repeatable, known := agentConfKeys[line.Key]
+		if !known {
+			problems = append(problems, fmt.Sprintf("line %d: unknown parameter %s", i+1, line.Key))
+		} else if seen[line.Key] && !repeatable {
+			problems = append(problems, fmt.Sprintf("line %d: duplicate parameter %s", i+1, line.Key))
+		}
+		seen[line.Key] = true
+	}
+	if len(problems) != 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ConfConflict is a parameter changed both by hand and by the installer since the last install.
+type ConfConflict struct {
+	Instance string   `json:"instance,omitempty"`
+	Key      string   `json:"key"`
+	Base     []string `json:"base"`
+	Local    []string `json:"local"`
+	New      []string `json:"new"`
+}
+
+// MergeAgentConf merges the changes from base to local into newConf, parameter by parameter.
+// base is the configuration written by the last install, local is the configuration on disk
+// and newConf the one written now. A parameter changed in local only keeps its local values,
+// one changed in both takes the new values and is returned as a conflict.
+// The lines of newConf are kept, a nil base is an empty configuration.
+func MergeAgentConf(base, local, newConf *AgentConf) (*AgentConf, []ConfConflict) {
+	if base == nil {
+		base = &AgentConf{}
+	}
+	merged := &AgentConf{lines: append([]confLine(nil), newConf.lines...)}
+	var conflicts []ConfConflict
+	seen := make(map[string]bool)
+	for _, key := range append(append(newConf.Keys(), local.Keys()...), base.Keys()...) {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		baseValues, localValues, newValues := base.GetAll(key), local.GetAll(key), newConf.GetAll(key)
+		switch {
+		case sameValues(localValues, baseValues), sameValues(localValues, newValues):
+			// unchanged by hand
+		case sameValues(newValues, baseValues):
+			merged.SetAll(key, localValues)
+		default:
+			conflicts = append(conflicts, ConfConflict{Key: key, Base: baseValues, Local: localValues, New: newValues})
+		}
+	}
+	return merged, conflicts
+}
+
+// sameValues returns true if a and b hold the same values in the same order
+func sameValues(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// SetConfParams sets the params in the configuration file.
+func SetConfParams(confAbsPath string, params map[string]string) error {
+	conf, err := ReadAgentConf(confAbsPath)
+	if err != nil {
+		return err
+	}
+	for key, value := range params {
+		conf.Set(key, value)
+	}
+	return conf.WriteFile(confAbsPath)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"zabbix_agent_installer/utils"
+)
+
+// confKeyRegexp matches a zabbix_agentd.conf parameter name
+var confKeyRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+
+// configure edits the configuration of the installed agent and restarts it if anything changed
+func configure(config *Config, result *Result) error {
+	configs, err := installedConfigs(config)
+	if err != nil {
+		return err
+	}
+	if len(configs) != 1 {
+		return Errorf(ValidationError, "configure changes one instance at a time")
+	}
+	config = configs[0]
+	var pathConfig = &PathConfig{}
+	err = locateAgent(config, pathConfig)
+	if err != nil {
+		return err
+	}
+	result.AddAgent(config, pathConfig, nil, nil, nil)
+	var conf *AgentConf
+	var params []ConfParam
+	err = result.Step("read config", func() error {
+		conf, err = ReadAgentConf(pathConfig.ZabbixAgentConfAbsPath)
+		if err != nil {
+			return NewError(FilesystemError, err)
+		}
+		params, err = ConfigureParams(config, conf)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(params) == 0 {
+		return Errorf(ValidationError, "nothing to configure, use -s, -hostname, -metadata, -metadata-format, -metadata-item, -listen-port or -set")
+	}
+	oldData := conf.Bytes()
+	for _, param := range params {
+		conf.Set(param.Key, param.Value)
+	}
+	err = result.Step("validate config", func() error {
+		err := ValidateConfParams(params)
+		if err == nil {
+			err = conf.Validate()
+		}
+		return NewError(ValidationError, err)
+	})
+	if err != nil {
+		return err
+	}
+	newData := conf.Bytes()
+	if bytes.Equal(oldData, newData) {
+		result.Skip("write config")
+		result.Skip("restart agent")
+		utils.Info("configuration unchanged", "conf", pathConfig.ZabbixAgentConfAbsPath)
+		return nil
+	}
+	diff := DiffLines(strings.Split(string(oldData), "\n"), strings.Split(string(newData), "\n"))
+	result.Diff = diff
+	PrintDiff(textOutput(config), pathConfig.ZabbixAgentConfAbsPath, diff)
+	err = result.Step("write config", func() error {
+		return NewError(FilesystemError, conf.WriteFile(pathConfig.ZabbixAgentConfAbsPath))
+	})
+	if err != nil {
+		return err
+	}
+	utils.Info("write config successfully", "conf", pathConfig.ZabbixAgentConfAbsPath)
+	config.ListenPort = DefaultListenPort
+	if port, ok := conf.Get("ListenPort"); ok {
+		config.ListenPort = port
+	}
+	err = result.Step("restart agent", func() error {
+		return NewError(ServiceError, restartAgent(config, pathConfig))
+	})
+	result.AddAgent(config, pathConfig, agentPids(pathConfig.ZabbixAgentBinAbsPath), agentServiceInfo(config, pathConfig), nil)
+	if err != nil {
+		return err
+	}
+	utils.Info("restart agent successfully")
+	return nil
+}
+
+// ConfParam is a parameter of zabbix_agentd.conf.
+type ConfParam struct {
+	Key   string
+	Value string
+}
+
+// ConfigureParams returns the parameters given on the command line, in a fixed order.
+// -s and -hostname ip fall back to the server in the current configuration.
+func ConfigureParams(config *Config, conf *AgentConf) ([]ConfParam, error) {
+	var params []ConfParam
+	if IsFlagSet("s") {
+		err := serverIPHandler(config)
+		if err != nil {
+			return nil, NewError(ValidationError, err)
+		}
+		params = append(params,
+			ConfParam{"Server", config.ServerIP},
+			ConfParam{"ServerActive", FormatServerActive(config.ServerIP, config.ServerPort)})
+	} else if IsFlagSet("p") {
+		return nil, Errorf(ValidationError, "-p needs -s")
+	}
+	if IsFlagSet("hostname") {
+		if config.Hostname == "ip" && config.AgentIP == "" && config.ServerIP == "" {
+			config.ServerIP, config.ServerPort = agentServer(config, conf)
+		}
+		if config.Hostname == "ip" {
+			err := agentIPHandler(config)
+			if err != nil {
+				return nil, NewError(NetworkError, err)
+			}
+		}
+		err := hostnameHandler(config)
+		if err != nil {
+			return nil, NewError(NetworkError, err)
+		}
+		params = append(params, ConfParam{"Hostname", config.Hostname})
+	}
+	if IsFlagSet("metadata") || IsFlagSet("metadata-format") {
+		err := metadataHandler(config)
+		if err != nil {
+			return nil, NewError(ValidationError, err)
+		}
+		params = append(params, ConfParam{"HostMetadata", config.HostMetadata})
+	}
+	if IsFlagSet("metadata-item") {
+		params = append(params, ConfParam{"HostMetadataItem", config.HostMetadataItem})
+	}
+	if IsFlagSet("listen-port") {
+		params = append(params, ConfParam{"ListenPort", config.ListenPort})
+	}
+	for _, set := range config.ConfParams {
+		key, value, ok := strings.Cut(set, "=")
+		if !ok {
+			return nil, Errorf(ValidationError, "invalid -set %s, use Key=Value", set)
+		}
+		params = append(params, ConfParam{strings.TrimSpace(key), strings.TrimSpace(value)})
+	}
+	return params, nil
+}
+
+// ValidateConfParams checks the parameters before they are written.
+func ValidateConfParams(params []ConfParam) error {
+	for _, param := range params {
+		if !confKeyRegexp.MatchString(param.Key) {
+			return fmt.Errorf("invalid parameter name: %s", param.Key)
+		}
+		if strings.ContainsAny(param.Value, "\r\n") {
+			return fmt.Errorf("invalid %s: line break in value", param.Key)
+		}
+		switch param.Key {
+		case "Server":
+			for _, server := range strings.Split(param.Value, ",") {
+				server = strings.TrimSpace(server)
+				if _, _, err := net.ParseCIDR(server); err != nil && !IsHostAddress(TrimBrackets(server)) {
+					return fmt.Errorf("invalid Server: %s", server)
+				}
+			}
+		case "ServerActive":
+			for _, server := range strings.Split(param.Value, ",") {
+				host, port := strings.TrimSpace(server), "10051"
+				if h, p, err := net.SplitHostPort(host); err == nil {
+					host, port = h, p
+				}
+				if n, err := strconv.Atoi(port); !IsHostAddress(TrimBrackets(host)) || err != nil || n < 1 || n > 65535 {
+					return fmt.Errorf("invalid ServerActive: %s", server)
+				}
+			}
+		case "Hostname":
+			if !hostnameRegexp.MatchString(param.Value) {
+				return fmt.Errorf("invalid Hostname: %s", param.Value)
+			}
+		case "ListenPort":
+			err := listenPortHandler(&Config{ListenPort: param.Value})
+			if err != nil {
+				return err
+			}
+		case "HostMetadata":
+			if len(param.Value) > maxHostMetadata {
+				return fmt.Errorf("HostMetadata is longer than %d characters", maxHostMetadata)
+			}
+		}
+	}
+	return nil
+}
+
+// restartAgent restarts the installed agent and waits until it listens
+func restartAgent(config *Config, pathConfig *PathConfig) error {
+	manager := DetectServiceManager(NewAgentService(config, pathConfig))
+	err := manager.Start()
+	if err != nil {
+		return err
+	}
+	return waitAgentListening(config, pathConfig)
+}
+
+// DiffLines returns the changes from a to b, removed lines start with "-" and added lines with "+".
+func DiffLines(a, b []string) []string {
+	// Longest common subsequence of the lines
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "-"+a[i])
+			i++
+		default:
+			diff = append(diff, "+"+b[j])
+			j++
+		}
+	}
+	return diff
+}
+
+// PrintDiff prints the changes of the file.
+func PrintDiff(w io.Writer, fileAbsPath string, diff []string) {
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", fileAbsPath, fileAbsPath)
+	for _, line := range diff {
+		fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,69 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"syscall"
+)
+
+// SetCommandUser makes the command run as the user, which drops the privileges of root.
+func SetCommandUser(cmd *exec.Cmd, username string) error {
+	uid, gid, err := LookupUserIDs(username)
+	if err != nil {
+		return err
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+	}
+	return nil
+}
+
+// CheckUserAccess returns an error if the user can not reach dirAbsPath,
+// the user needs the search permission on every directory of the path.
+// A user which does not exist yet only gets the permissions of others.
+func CheckUserAccess(dirAbsPath string, username string) error {
+	uid, gid := -1, -1
+	if _, err := user.Lookup(username); err == nil {
+		uid, gid, err = LookupUserIDs(username)
+		if err != nil {
+			return err
+		}
+	}
+	for dir := dirAbsPath; ; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		perm := info.Mode().Perm()
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		allowed := perm&0001 != 0
+		if int(stat.Uid) == uid {
+			allowed = perm&0100 != 0
+		} else if int(stat.Gid) == gid {
+			allowed = perm&0010 != 0
+		}
+		if !allowed {
+			return fmt.Errorf("%s is not accessible by %s", dir, username)
+		}
+		if filepath.Dir(dir) == dir {
+			return nil
+		}
+	}
+}
+
+// CopyOwner gives absPath the owner and group of the file described by fileInfo.
+func CopyOwner(fileInfo os.FileInfo, absPath string) error {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return os.Lchown(absPath, int(stat.Uid), int(stat.Gid))
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// SetCommandUser is not supported on windows, the agent runs as a service there.
+func SetCommandUser(cmd *exec.Cmd, username string) error {
+	return fmt.Errorf("run command as %s: not supported on windows", username)
+}
+
+// CheckUserAccess is not needed on windows, the agent service runs as LocalSystem.
+func CheckUserAccess(dirAbsPath string, username string) error {
+	return nil
+}
+
+// CopyOwner does nothing on windows, files inherit the permissions of the directory.
+func CopyOwner(fileInfo os.FileInfo, absPath string) error {
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"zabbix_agent_installer/utils"
+)
+
+// cronMarker prefixes the comment line placed above each installer crontab entry,
+// the rest of the comment identifies the entry.
+const cronMarker = "# zabbix_agent_installer: "
+
+// DefaultCronSchedule is the default schedule of the watchdog entry.
+const DefaultCronSchedule = "*/10 * * * *"
+
+// CronEntry returns the watchdog entry which keeps the agent started by the script alive.
+func CronEntry(schedule string, scriptAbsPath string) string {
+	return fmt.Sprintf("%s /bin/sh %s daemon > /dev/null 2>&1", schedule, scriptAbsPath)
+}
+
+// IsCronSchedule returns true if the schedule has five time fields or is a @ shortcut.
+func IsCronSchedule(schedule string) bool {
+	if strings.HasPrefix(schedule, "@") {
+		switch schedule {
+		case "@reboot", "@yearly", "@annually", "@monthly", "@weekly", "@daily", "@midnight", "@hourly":
+			return true
+		}
+		return false
+	}
+	return len(strings.Fields(schedule)) == 5
+}
+
+// NewCronFile Edit the crontab file
+func NewCronFile(cron string) (string, error) {
+	cronAbsPath := NewCronTempFile()
+	f, err := os.OpenFile(cronAbsPath, os.O_CREATE|(os.O_RDWR|os.O_TRUNC), 0644)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		err = f.Close()
+		if err != nil {
+			utils.Warn("close crontab file failed", "file", cronAbsPath, "error", err)
+			return
+		}
+	}()
+	_, err = f.WriteString(cron)
+	if err != nil {
+		return "", err
+	}
+	return cronAbsPath, nil
+}
+
+// NewCronTempFile Generate a crontab path
+func NewCronTempFile() (absPath string) {
+	randString := RandStringBytes(6)
+	return filepath.Join(os.TempDir(), "crontab."+randString)
+}
+
+// crontabArgs returns the crontab arguments editing the crontab of the user.
+// Only root can edit the crontab of another user.
+func crontabArgs(username string, args ...string) []string {
+	if IsOtherUser(username) {
+		return append([]string{"-u", username}, args...)
+	}
+	return args
+}
+
+// ReadCrontab returns the crontab of the user, a missing crontab is empty.
+func ReadCrontab(username string) (string, error) {
+	output, err := exec.Command("crontab", crontabArgs(username, "-l")...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			// cronie and vixie cron: "no crontab for user", busybox: "can't open 'user'"
+			stderr := string(exitErr.Stderr)
+			if strings.Contains(stderr, "no crontab") || strings.Contains(stderr, "can't open") {
+				return "", nil
+			}
+			return "", fmt.Errorf("crontab -l: %s", strings.TrimSpace(stderr))
+		}
+		return "", err
+	}
+	return string(output), nil
+}
+
+// WriteCrontab replaces the crontab of the user with cron.
+func WriteCrontab(username string, cron string) error {
+	dstCronFileAbsPath, err := NewCronFile(cron)
+	if err != nil {
+		return err
+	}
+	// Remove the temp crontab file
+	defer os.Remove(dstCronFileAbsPath)
+	// Rewrite the crontab
+	_, err = RunCommand("crontab", crontabArgs(username, dstCronFileAbsPath)...)
+	return err
+}
+
+// FindCronEntry returns the entry marked with id in the crontab of the user.
+func FindCronEntry(username string, id string) (string, bool, error) {
+	cron, err := ReadCrontab(username)
+	if err != nil {
+		return "", false, err
+	}
+	lines := splitCronLines(cron)
+	for i := range lines {
+		if lines[i] == cronMarker+id && i+1 < len(lines) {
+			return lines[i+1], true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// SetCronEntry adds the entry marked with id to the crontab of the user, or updates it if it exists.
+func SetCronEntry(username string, id string, entry string) error {
+	cron, err := ReadCrontab(username)
+	if err != nil {
+		return err
+	}
+	newCron := setCronEntry(cron, id, entry)
+	if newCron == cron {
+		return nil
+	}
+	return WriteCrontab(username, newCron)
+}
+
+// RemoveCronEntry removes the entry marked with id from the crontab of the user.
+func RemoveCronEntry(username string, id string) error {
+	cron, err := ReadCrontab(username)
+	if err != nil {
+		return err
+	}
+	newCron := removeCronEntry(cron, id)
+	if newCron == cron {
+		return nil
+	}
+	return WriteCrontab(username, newCron)
+}
+
+// setCronEntry returns cron with the entry marked with id set to entry.
+// Unmarked entries which run id, written by older installers, are replaced as well.
+func setCronEntry(cron string, id string, entry string) string {
+	var result []string
+	found := false
+	lines := splitCronLines(cron)
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if line == cronMarker+id {
+			// Skip the marked entry
+			i++
+			if !found {
+				result = append(result, cronMarker+id, entry)
+				found = true
+			}
+			continue
+		}
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") && hasCronField(line, id) {
+			continue
+		}
+		result = append(result, line)
+	}
+	if !found {
+		result = append(result, cronMarker+id, entry)
+	}
+	return strings.Join(result, "\n") + "\n"
+}
+
+// hasCronField returns true if field is one of the whitespace separated fields of the crontab line
+func hasCronField(line string, field string) bool {
+	for _, f := range strings.Fields(line) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// removeCronEntry returns cron without the entry marked with id.
+func removeCronEntry(cron string, id string) string {
+	var result []string
+	lines := splitCronLines(cron)
+	for i := 0; i < len(lines); i++ {
+		if lines[i] == cronMarker+id {
+			i++
+			continue
+		}
+		result = append(result, lines[i])
+	}
+	if len(result) == 0 {
+		return ""
+	}
+	return strings.Join(result, "\n") + "\n"
+}
+
+// splitCronLines splits the crontab into lines without line endings.
+func splitCronLines(cron string) []string {
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(cron))
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	return lines
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorKind is the category of an installer error, each category has its own exit code.
+type ErrorKind int
+
+const (
+	UnknownError ErrorKind = iota
+	ValidationError
+	NetworkError
+	PackageError
+	FilesystemError
+	ServiceError
+)
+
+// Exit codes, documented in README.md
+const (
+	ExitOK         = 0
+	ExitFailure    = 1 // unknown error, or a failed preflight check
+	ExitWarning    = 2 // preflight checks passed with warnings
+	ExitValidation = 3 // invalid option or configuration
+	ExitNetwork    = 4 // download or address detection failed, host registration failed
+	ExitPackage    = 5 // package missing, unknown or corrupt
+	ExitFilesystem = 6 // directory, permission or disk space problem
+	ExitService    = 7 // agent user, service or crontab registration, agent start failed
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ValidationError:
+		return "validation"
+	case NetworkError:
+		return "network"
+	case PackageError:
+		return "package"
+	case FilesystemError:
+		return "filesystem"
+	case ServiceError:
+		return "service"
+	}
+	return "unknown"
+}
+
+// ExitCode returns the exit code of the kind.
+func (k ErrorKind) ExitCode() int {
+	switch k {
+	case ValidationError:
+		return ExitValidation
+	case NetworkError:
+		return ExitNetwork
+	case PackageError:
+		return ExitPackage
+	case FilesystemError:
+		return ExitFilesystem
+	case ServiceError:
+		return ExitService
+	}
+	return ExitFailure
+}
+
+// InstallerError is an error with a category.
+type InstallerError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *InstallerError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InstallerError) Unwrap() error {
+	return e.Err
+}
+
+// NewError returns err with the kind, an error which already has a kind keeps it.
+func NewError(kind ErrorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	var installerErr *InstallerError
+	if errors.As(err, &installerErr) {
+		return err
+	}
+	return &InstallerError{Kind: kind, Err: err}
+}
+
+// Errorf formats an error with the kind.
+func Errorf(kind ErrorKind, format string, a ...interface{}) error {
+	return &InstallerError{Kind: kind, Err: fmt.Errorf(format, a...)}
+}
+
+// GetErrorKind returns the kind of err, UnknownError if it has none.
+func GetErrorKind(err error) ErrorKind {
+	var installerErr *InstallerError
+	if errors.As(err, &installerErr) {
+		return installerErr.Kind
+	}
+	return UnknownError
+}
+
+// ExitCode returns the exit code of err.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	return GetErrorKind(err).ExitCode()
+}
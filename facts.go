@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"zabbix_agent_installer/utils"
+
+	"github.com/shirou/gopsutil/host"
+	"github.com/shirou/gopsutil/mem"
+)
+
+// maxHostMetadata is the longest HostMetadata accepted by the zabbix server
+const maxHostMetadata = 255
+
+// dmiDir holds the DMI information of the machine on linux
+var dmiDir = "/sys/class/dmi/id"
+
+// HostFacts describes the host the agent is installed on.
+type HostFacts struct {
+	OS             string            `json:"os"`
+	OSName         string            `json:"os_name"`
+	OSVersion      string            `json:"os_version"`
+	Arch           string            `json:"arch"`
+	Hostname       string            `json:"hostname"`
+	FQDN           string            `json:"fqdn"`
+	IPs            []string          `json:"ips"`
+	CPUs           int               `json:"cpus"`
+	MemoryMB       uint64            `json:"memory_mb"`
+	Virtualization string            `json:"virtualization"`
+	Cloud          string            `json:"cloud"`
+	Tags           map[string]string `json:"tags"`
+}
+
+// ReadHostFacts reads the facts of the host, facts which cannot be read are left empty.
+func ReadHostFacts(config *Config) *HostFacts {
+	facts := &HostFacts{OS: config.OSType, Arch: config.OSArch, IPs: []string{}, CPUs: runtime.NumCPU()}
+	switch config.OSType {
+	case "linux":
+		facts.OSName, facts.OSVersion = utils.GetLinuxVersion()
+	case "windows":
+		facts.OSName, facts.OSVersion = "windows", utils.GetWindowsVersion()
+	}
+	facts.Hostname, _ = os.Hostname()
+	facts.FQDN, _ = GetFQDN()
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.IsGlobalUnicast() {
+			facts.IPs = append(facts.IPs, ipNet.IP.String())
+		}
+	}
+	if memory, err := mem.VirtualMemory(); err == nil {
+		facts.MemoryMB = memory.Total >> 20
+	}
+	facts.Virtualization = "none"
+	if system, role, err := host.Virtualization(); err == nil && role == "guest" && system != "" {
+		facts.Virtualization = system
+	}
+	facts.Cloud = DetectCloud(ReadDMI(dmiDir))
+	facts.Tags, _ = ParseTags(config.Tags)
+	return facts
+}
+
+// ReadDMI reads the vendor and product fields of the DMI information in dir.
+func ReadDMI(dir string) map[string]string {
+	dmi := make(map[string]string)
+	for _, name := range []string{"sys_vendor", "product_name", "bios_vendor", "chassis_asset_tag", "chassis_vendor"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			dmi[name] = strings.TrimSpace(string(data))
+		}
+	}
+	return dmi
+}
+
+// DetectCloud returns the cloud provider found in the DMI fields, or none.
+func DetectCloud(dmi map[string]string) string {
+	vendor := dmi["sys_vendor"] + " " + dmi["bios_vendor"] + " " + dmi["chassis_vendor"]
+	product := dmi["product_name"]
+	switch {
+	case strings.Contains(vendor, "Amazon EC2"):
+		return "aws"
+	case strings.Contains(vendor, "Google") || strings.Contains(product, "Google Compute Engine"):
+		return "gcp"
+	case dmi["chassis_asset_tag"] == "7783-7084-3265-9085-8269-3286-77":
+		return "azure"
+	case strings.Contains(vendor, "Alibaba Cloud") || strings.Contains(product, "Alibaba Cloud ECS"):
+		return "alibaba"
+	case strings.Contains(vendor, "Tencent Cloud"):
+		return "tencent"
+	case strings.Contains(vendor, "Huawei Cloud") || strings.Contains(product, "Huawei Cloud"):
+		return "huawei"
+	case strings.Contains(vendor, "DigitalOcean"):
+		return "digitalocean"
+	case strings.Contains(vendor, "OpenStack") || strings.Contains(product, "OpenStack"):
+		return "openstack"
+	}
+	return "none"
+}
+
+// ParseTags parses the -tag key=value options, a tag without value is set to true.
+func ParseTags(tags []string) (map[string]string, error) {
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		key, value, ok := strings.Cut(tag, "=")
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, fmt.Errorf("invalid -tag %s, use key=value", tag)
+		}
+		if !ok {
+			value = "true"
+		}
+		m[key] = strings.TrimSpace(value)
+	}
+	return m, nil
+}
+
+// formatTags returns the tags as key=value pairs sorted by key
+func formatTags(tags map[string]string) string {
+	var pairs []string
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// ComposeHostMetadata renders the -metadata-format template with the host facts.
+func ComposeHostMetadata(config *Config) (string, error) {
+	data, err := NewTemplateData(config, &PathConfig{})
+	if err != nil {
+		return "", err
+	}
+	metadata, err := RenderTemplate("metadata-format", config.MetadataFormat, data)
+	if err != nil {
+		return "", err
+	}
+	// HostMetadata is a single line
+	return strings.Join(strings.Fields(string(metadata)), " "), nil
+}
+
+// metadataHandler processes the Tags, HostMetadata and MetadataFormat
+func metadataHandler(config *Config) error {
+	_, err := ParseTags(config.Tags)
+	if err != nil {
+		return err
+	}
+	if config.MetadataFormat != "" {
+		if config.HostMetadata != "" {
+			return fmt.Errorf("use -metadata or -metadata-format")
+		}
+		config.HostMetadata, err = ComposeHostMetadata(config)
+		if err != nil {
+			return err
+		}
+	}
+	if len(config.HostMetadata) > maxHostMetadata {
+		return fmt.Errorf("HostMetadata is longer than %d characters: %s", maxHostMetadata, config.HostMetadata)
+	}
+	return nil
+}
@@ -5,10 +5,17 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"zabbix_agent_installer/utils"
 )
 
+// hostnameRegexp matches the Hostname accepted by zabbix
+var hostnameRegexp = regexp.MustCompile(`^[0-9A-Za-z._ -]{1,128}$`)
+
 // ReadOSInfo reads the runtime information.
 func ReadOSInfo(config *Config) error {
 	config.OSType = runtime.GOOS
@@ -25,63 +32,254 @@ func ReadOSInfo(config *Config) error {
 // ReadConfig reads the configuration from the stdin.
 func ReadConfig(config *Config) {
 	// Receive the command
-	flag.StringVar(&config.ServerIP, "s", "", "zabbix server ip.")
+	flag.StringVar(&config.ServerIP, "s", "", "zabbix server or proxy ip, IPv6 or DNS name.")
 	flag.StringVar(&config.ServerPort, "p", "8001", "zabbix server port.")
-	flag.StringVar(&config.AgentIP, "i", "", "zabbix agent ip. default is the main ip.")
+	flag.StringVar(&config.AgentIP, "i", "", "zabbix agent ip, IPv6 or DNS name. default is the ip routing to the zabbix server.")
+	flag.StringVar(&config.AgentIface, "iface", "", "use the ip of this network interface as agent ip, like eth1.")
+	flag.StringVar(&config.AgentSubnet, "subnet", "", "use the ip in this subnet as agent ip, like 10.0.0.0/8.")
+	flag.StringVar(&config.Hostname, "hostname", "ip", "zabbix agent Hostname: ip (with - for the : of an IPv6), fqdn, short or a name.")
+	flag.StringVar(&config.Template, "template", "", "text/template file rendered to zabbix_agentd.conf. default is the built-in template.")
+	flag.Var((*stringsFlag)(&config.TemplateVars), "var", "template variable, like tenant=acme, used as {{.Var.tenant}}. can be repeated.")
+	flag.StringVar(&config.HostMetadata, "metadata", "", "zabbix agent HostMetadata for auto-registration.")
+	flag.StringVar(&config.MetadataFormat, "metadata-format", "", "text/template composing HostMetadata from the host facts, like '{{.Facts.OSName}} {{.Facts.Cloud}} {{tags .Facts.Tags}}'.")
+	flag.StringVar(&config.HostMetadataItem, "metadata-item", "", "zabbix agent HostMetadataItem, like system.uname.")
+	flag.Var((*stringsFlag)(&config.Tags), "tag", "environment tag of the host, like env=prod, used in -metadata-format. can be repeated.")
+	flag.StringVar(&config.TLS, "tls", "", "encrypt the agent connections: psk or cert. default is unencrypted.")
+	flag.StringVar(&config.TLSPSK, "tls-psk", "", "PSK in hex for -tls psk. default is a random 256-bit PSK.")
+	flag.StringVar(&config.TLSPSKIdentity, "tls-psk-identity", "", "PSK identity for -tls psk. default is the Hostname.")
+	flag.StringVar(&config.TLSCAFile, "tls-ca", "", "CA certificate file for -tls cert.")
+	flag.StringVar(&config.TLSCertFile, "tls-cert", "", "agent certificate file for -tls cert.")
+	flag.StringVar(&config.TLSKeyFile, "tls-key", "", "agent private key file for -tls cert.")
+	flag.StringVar(&config.APIURL, "api-url", "", "register the host through the zabbix API after install, like https://zabbix.example.com/api_jsonrpc.php.")
+	flag.StringVar(&config.APIToken, "api-token", "", "zabbix API token. default is $"+APITokenEnv+".")
+	flag.StringVar(&config.APIUser, "api-user", "", "zabbix API user, when there is no API token.")
+	flag.StringVar(&config.APIPassword, "api-password", "", "zabbix API password. default is $"+APIPasswordEnv+".")
+	flag.Var((*listFlag)(&config.HostGroups), "host-groups", "comma separated host groups of the registered host.")
+	flag.Var((*listFlag)(&config.Templates), "templates", "comma separated templates linked to the registered host.")
+	flag.Var((*stringsFlag)(&config.Macros), "macro", "user macro of the registered host, like {$ENV}=prod. can be repeated.")
+	flag.StringVar(&config.UserParams, "userparams", "", "directory, .tar.gz or .zip of UserParameter *.conf files and their scripts, deployed into the Include directory zabbix_agentd.d.")
+	flag.Var((*stringsFlag)(&config.ConfParams), "set", "set a zabbix_agentd.conf parameter, like Timeout=10. used by configure, can be repeated.")
 	flag.StringVar(&config.PackageURL, "l", "", "zabbix agent package URL.")
 	flag.StringVar(&config.PackageName, "f", "", "zabbix agent package name.")
-	flag.StringVar(&config.AgentDir, "d", "", "zabbix agent directory. default is current dir.")
-	flag.StringVar(&config.AgentUser, "u", "", "zabbix agent user. default is current user.")
+	flag.StringVar(&config.AgentDir, "d", "", "zabbix agent directory, ~ and $VAR are expanded. default is the home of the current user.")
+	flag.StringVar(&config.AgentUser, "u", "", "zabbix agent user. default is zabbix for root, otherwise the current user.")
+	flag.StringVar(&config.CronSchedule, "cron", DefaultCronSchedule, "schedule of the crontab watchdog entry.")
+	flag.StringVar(&config.ListenPort, "listen-port", DefaultListenPort, "zabbix agent listen port.")
+	flag.Var((*listFlag)(&config.Instances), "instances", "comma separated names of agent instances, installed in zabbix_agentd_<name> with ListenPort, ListenPort+1 ... all selects the installed instances for status and uninstall.")
+	flag.BoolVar(&config.MultipleAgents, "multiple-agents", false, "give the service a name of its own, Zabbix Agent [Hostname] on windows and zabbix_agentd_<dir name> on linux, so that several agents can be installed.")
+	flag.StringVar(&config.BackupName, "backup", "", "backup to restore: a name listed by backup -list, a path, or latest.")
+	flag.BoolVar(&config.BackupLogs, "backup-logs", false, "also archive the log files in the backup.")
+	flag.BoolVar(&config.ListBackups, "list", false, "list the backups instead of creating one.")
+	flag.BoolVar(&config.AutoPort, "auto-port", false, "listen on the next free port if the listen port is in use.")
+	flag.StringVar(&config.LogFile, "log-file", "", "also write the log to this file.")
+	flag.StringVar(&config.LogFormat, "log-format", utils.TextFormat, "log format: text or json.")
+	flag.Int64Var(&config.LogMaxSize, "log-max-size", 10, "rotate the log file at this size in MB.")
+	flag.BoolVar(&config.Verbose, "v", false, "verbose, log debug messages.")
+	flag.BoolVar(&config.Quiet, "q", false, "quiet, only log warnings and errors.")
+	flag.StringVar(&config.Output, "output", TextOutput, "result output: text, or json to print a result document and log to stderr.")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [command] [options]\n\n", os.Args[0])
+		fmt.Fprintf(out, "Commands:\n")
+		fmt.Fprintf(out, "  install    install and start the zabbix agent (default)\n")
+		fmt.Fprintf(out, "  preflight  check the system before installing\n")
+		fmt.Fprintf(out, "  status     report the installed zabbix agent\n")
+		fmt.Fprintf(out, "  configure  change the configuration of the installed zabbix agent\n")
+		fmt.Fprintf(out, "  uninstall  stop and remove the installed zabbix agent\n")
+		fmt.Fprintf(out, "  backup     archive the installed zabbix agent into backups, -list lists the backups\n")
+		fmt.Fprintf(out, "  restore    restore the zabbix agent from the -backup and start it\n\n")
+		fmt.Fprintf(out, "Options:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 }
 
-// serverIPHandler processes the ServerIP.
+// stringsFlag is a flag which can be given several times
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// listFlag is a comma separated list
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// IsFlagSet returns true if the option was given on the command line.
+func IsFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// ReadCommand returns the command given before or after the options, install is the default.
+func ReadCommand() (string, error) {
+	if flag.NArg() == 0 {
+		return "install", nil
+	}
+	command := flag.Arg(0)
+	// Parse the options following the command
+	err := flag.CommandLine.Parse(flag.Args()[1:])
+	if err != nil {
+		return "", err
+	}
+	if flag.NArg() != 0 {
+		return "", fmt.Errorf("unexpected argument: %s", flag.Arg(0))
+	}
+	return command, nil
+}
+
+// serverIPHandler processes the ServerIP, an IPv4, IPv6 or DNS name.
 func serverIPHandler(config *Config) error {
+	config.ServerIP = TrimBrackets(config.ServerIP)
 	if config.ServerIP == "" {
 		return errors.New("must input the zabbix server ip")
-	} else if !IsIPv4(config.ServerIP) {
-		return errors.New("invalid server ip")
+	} else if !IsHostAddress(config.ServerIP) {
+		return errors.New("invalid server ip or hostname")
 	}
 	return nil
 }
 
 // agentUserHandler processes the AgentUser.
-// If not specify a user, use current user default,
-// If user is specified,check if the current user is the specified user.
+// If root installs the agent, it runs as a dedicated system user, zabbix by default.
+// If a normal user installs the agent, it can only run as the current user.
 func agentUserHandler(config *Config) error {
-	if os.Getuid() == 0 && config.AgentUser == "" {
-		return errors.New("switch to normal user then install")
+	if config.OSType == "windows" {
+		return nil
 	}
-	if os.Getuid() != -1 {
-		currentUser, _ := GetCurrentUser()
-		if config.AgentUser != "" && currentUser != config.AgentUser {
-			return fmt.Errorf("switch to %s then install", config.AgentUser)
+	if IsRoot() {
+		if config.AgentUser == "" {
+			config.AgentUser = DefaultAgentUser
 		}
+		return nil
+	}
+	currentUser, err := GetCurrentUser()
+	if err != nil {
+		return err
+	}
+	if config.AgentUser == "" {
+		config.AgentUser = currentUser
+	} else if currentUser != config.AgentUser {
+		return fmt.Errorf("switch to %s or root then install", config.AgentUser)
 	}
 	return nil
 }
 
-// agentDirHandler processes the AgentDir
+// ResolveAgentDir returns the absolute AgentDir without touching the filesystem.
+func ResolveAgentDir(config *Config) (string, error) {
+	dir := config.AgentDir
+	if dir == "" {
+		if IsOtherUser(config.AgentUser) {
+			dir = "/opt"
+		} else {
+			home, err := GetUserHomePath()
+			if err != nil {
+				return "", err
+			}
+			dir = home
+		}
+	}
+	return ExpandPath(dir)
+}
+
+// agentDirHandler processes the AgentDir.
+// ~ and environment variables are expanded, the directory is created if missing.
+// If not specify a dir, use the home of the current user, or /opt when root installs for another user.
 func agentDirHandler(config *Config) error {
-	dir, err := os.Getwd()
+	dir, err := ResolveAgentDir(config)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	err = CheckWritable(dir)
 	if err != nil {
 		return err
 	}
+	if IsOtherUser(config.AgentUser) {
+		err = CheckUserAccess(dir, config.AgentUser)
+		if err != nil {
+			return err
+		}
+	}
 	config.AgentDir = dir
 	return nil
 }
 
-// agentIPHandler processes the AgentIP
+// agentIPHandler processes the AgentIP.
+// If not specify an ip, use the address of -iface, the address in -subnet,
+// or the address routing to the zabbix server, in this order.
 func agentIPHandler(config *Config) error {
-	agent := config.AgentIP
-	if agent == "" {
-		agent, err := GetMainIP()
-		if err != nil {
-			return errors.New("get agent ip failed")
+	if config.AgentIP != "" {
+		config.AgentIP = TrimBrackets(config.AgentIP)
+		if !IsHostAddress(config.AgentIP) {
+			return Errorf(ValidationError, "invalid agent ip or hostname")
 		}
-		config.AgentIP = agent
-	} else if !IsIPv4(agent) {
-		return errors.New("invalid agent ip")
+		return nil
+	}
+	var agent string
+	var err error
+	switch {
+	case config.AgentIface != "":
+		agent, err = GetInterfaceIP(config.AgentIface)
+	case config.AgentSubnet != "":
+		agent, err = GetSubnetIP(config.AgentSubnet)
+	default:
+		agent, err = GetMainIP(config.ServerIP, config.ServerPort)
+	}
+	if err != nil {
+		return fmt.Errorf("get agent ip failed: %s", err.Error())
+	}
+	config.AgentIP = agent
+	return nil
+}
+
+// hostnameHandler processes the Hostname.
+// ip, fqdn and short are replaced by the agent ip, the FQDN and the short hostname,
+// other values are used as is. The ':' of an IPv6 agent ip, refused by zabbix, are replaced by '-'.
+func hostnameHandler(config *Config) error {
+	var err error
+	switch config.Hostname {
+	case "", "ip":
+		config.Hostname = config.AgentIP
+		if strings.Contains(config.Hostname, ":") {
+			config.Hostname, _, _ = strings.Cut(config.Hostname, "%")
+			config.Hostname = strings.ReplaceAll(config.Hostname, ":", "-")
+			utils.Info("use hostname of the ipv6 agent ip", "ip", config.AgentIP, "hostname", config.Hostname)
+		}
+	case "fqdn":
+		config.Hostname, err = GetFQDN()
+	case "short":
+		config.Hostname, err = GetShortHostname()
+	}
+	if err != nil {
+		return err
+	}
+	if !hostnameRegexp.MatchString(config.Hostname) {
+		return Errorf(ValidationError, "invalid hostname: %s, pass -hostname fqdn or a hostname", config.Hostname)
 	}
 	return nil
 }
@@ -96,18 +294,39 @@ func serverPortHandler(config *Config) error {
 	return nil
 }
 
+// cronScheduleHandler processes the CronSchedule
+func cronScheduleHandler(config *Config) error {
+	config.CronSchedule = strings.TrimSpace(config.CronSchedule)
+	if !IsCronSchedule(config.CronSchedule) {
+		return fmt.Errorf("invalid cron schedule: %s", config.CronSchedule)
+	}
+	return nil
+}
+
+// listenPortHandler processes the ListenPort
+func listenPortHandler(config *Config) error {
+	port, err := strconv.Atoi(config.ListenPort)
+	if err != nil || port < 1024 || port > 65535 {
+		return fmt.Errorf("invalid listen port: %s", config.ListenPort)
+	}
+	return nil
+}
+
 // packageNameHandler processes the package name
 func packageNameHandler(config *Config) error {
 	if config.PackageName == "" {
 		return nil
 	}
 	fileInfo, err := os.Stat(config.PackageName)
-	checkError(err, EXIT)
+	if err != nil {
+		return err
+	}
 	fileMode := fileInfo.Mode()
 	if fileMode.IsDir() {
 		return fmt.Errorf("invalid package name: %s", config.PackageName)
 	}
-	return nil
+	config.PackageName, err = filepath.Abs(config.PackageName)
+	return err
 }
 
 // packageURL processes the PackageURL
@@ -118,41 +337,129 @@ func packageURLHandler(config *Config) error {
 	}
 	reg, err := regexp.Compile(`[a-zA-z]+://[^\s]*`)
 	if err != nil {
-		return fmt.Errorf(err.Error())
+		return err
 	}
 	if !reg.MatchString(packageURL) {
-		return fmt.Errorf("invalid package URL: %s", packageURL)
+		return Errorf(ValidationError, "invalid package URL: %s", packageURL)
+	}
+	packageName, err := DownloadPackage(config.PackageURL, config.AgentDir)
+	if err != nil {
+		return err
 	}
-	config.PackageName, err = DownloadPackage(config.PackageURL, config.AgentDir)
-	checkError(err, EXIT)
+	config.PackageName = filepath.Join(config.AgentDir, packageName)
 	return nil
 }
 
+// diskSpaceHandler checks the free space of AgentDir against the unpacked package
+func diskSpaceHandler(config *Config) error {
+	size, err := utils.UnpackedSize(config.PackageName)
+	if err != nil {
+		return NewError(PackageError, err)
+	}
+	if len(config.Instances) > 1 {
+		size *= uint64(len(config.Instances))
+	}
+	free, err := GetFreeSpace(config.AgentDir)
+	if err != nil {
+		return err
+	}
+	if free < size {
+		return fmt.Errorf("not enough space in %s: %d bytes free, %d bytes needed", config.AgentDir, free, size)
+	}
+	return nil
+}
+
+// ProcessConfig checks and completes the configuration.
+// The returned error has the kind of the failed check.
 func ProcessConfig(config *Config) error {
 	var err error
 	// Check server ip
 	err = serverIPHandler(config)
-	checkError(err, EXIT)
+	if err != nil {
+		return NewError(ValidationError, err)
+	}
 	// Check server port
 	err = serverPortHandler(config)
-	checkError(err, CONTINUE)
-	// Check server dir
+	if err != nil {
+		utils.Warn(err.Error())
+	}
+	// Check agent user
+	err = agentUserHandler(config)
+	if err != nil {
+		return NewError(ValidationError, err)
+	}
+	// Check agent dir
 	err = agentDirHandler(config)
-	checkError(err, EXIT)
+	if err != nil {
+		return NewError(FilesystemError, err)
+	}
 	// Check agent ip
 	err = agentIPHandler(config)
-	checkError(err, EXIT)
-	// Check agent user
-	err = agentUserHandler(config)
-	checkError(err, EXIT)
+	if err != nil {
+		return NewError(NetworkError, err)
+	}
+	// Check hostname
+	err = hostnameHandler(config)
+	if err != nil {
+		return NewError(NetworkError, err)
+	}
+	// Check host metadata
+	err = metadataHandler(config)
+	if err != nil {
+		return NewError(ValidationError, err)
+	}
+	// Check encryption
+	err = tlsHandler(config)
+	if err != nil {
+		return NewError(ValidationError, err)
+	}
+	// Check user parameters
+	err = userParamsHandler(config)
+	if err != nil {
+		return NewError(ValidationError, err)
+	}
+	// Check zabbix API
+	err = apiHandler(config)
+	if err != nil {
+		return NewError(ValidationError, err)
+	}
+	// Check instances
+	err = instancesHandler(config)
+	if err != nil {
+		return NewError(ValidationError, err)
+	}
+	// Check template
+	err = templateHandler(config)
+	if err != nil {
+		return NewError(ValidationError, err)
+	}
+	// Check cron schedule
+	err = cronScheduleHandler(config)
+	if err != nil {
+		return NewError(ValidationError, err)
+	}
+	// Check listen port
+	err = listenPortHandler(config)
+	if err != nil {
+		return NewError(ValidationError, err)
+	}
 	// Check package name
 	err = packageNameHandler(config)
-	checkError(err, CONTINUE)
+	if err != nil {
+		return NewError(PackageError, err)
+	}
 	// Check package URL
 	err = packageURLHandler(config)
-	checkError(err, EXIT)
+	if err != nil {
+		return NewError(NetworkError, err)
+	}
 	if config.PackageName == "" && config.PackageURL == "" {
-		return fmt.Errorf("use -f or -l to specify package URI")
+		return Errorf(ValidationError, "use -f or -l to specify package URI")
+	}
+	// Check disk space
+	err = diskSpaceHandler(config)
+	if err != nil {
+		return NewError(FilesystemError, err)
 	}
 	return nil
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"zabbix_agent_installer/utils"
+)
+
+// AllInstances selects every installed instance for status and uninstall.
+const AllInstances = "all"
+
+// instanceDirPrefix is the directory name of the agent, instances add _<name>
+const instanceDirPrefix = "zabbix_agentd"
+
+// instanceRegexp matches an instance name
+var instanceRegexp = regexp.MustCompile(`^[0-9A-Za-z_-]{1,32}$`)
+
+// instancesHandler processes the Instances
+func instancesHandler(config *Config) error {
+	if len(config.Instances) == 0 {
+		return nil
+	}
+	if config.OSType == "windows" {
+		return fmt.Errorf("instances are only supported on linux, use -multiple-agents")
+	}
+	seen := make(map[string]bool)
+	for _, name := range config.Instances {
+		if name == AllInstances && len(config.Instances) == 1 {
+			continue
+		}
+		if !instanceRegexp.MatchString(name) || name == AllInstances {
+			return fmt.Errorf("invalid instance name: %s", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate instance: %s", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// AgentDirName returns the name of the agent directory in AgentDir.
+func AgentDirName(config *Config) string {
+	if config.OSType == "windows" {
+		return "zabbix"
+	}
+	if config.Instance != "" {
+		return instanceDirPrefix + "_" + config.Instance
+	}
+	return instanceDirPrefix
+}
+
+// FindInstances returns the instances installed in agentDir, "" is the agent without instance name.
+func FindInstances(agentDir string) ([]string, error) {
+	entries, err := os.ReadDir(agentDir)
+	if err != nil {
+		return nil, err
+	}
+	var instances []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || IsFileNotExist(filepath.Join(agentDir, name, "sbin", "zabbix_agentd")) {
+			continue
+		}
+		if name == instanceDirPrefix {
+			instances = append(instances, "")
+		} else if instance := strings.TrimPrefix(name, instanceDirPrefix+"_"); instance != name && instanceRegexp.MatchString(instance) {
+			instances = append(instances, instance)
+		}
+	}
+	return instances, nil
+}
+
+// InstanceConfigs returns a copy of config for each instance to work on.
+// Without -instances it is config itself, -instances all selects the installed instances.
+func InstanceConfigs(config *Config) ([]*Config, error) {
+	names := config.Instances
+	if len(names) == 1 && names[0] == AllInstances {
+		var err error
+		names, err = FindInstances(config.AgentDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no zabbix agent installed in %s", config.AgentDir)
+		}
+	}
+	if len(names) == 0 {
+		return []*Config{config}, nil
+	}
+	var configs []*Config
+	for _, name := range names {
+		instanceConfig := *config
+		instanceConfig.Instance = name
+		configs = append(configs, &instanceConfig)
+	}
+	return configs, nil
+}
+
+// InstallConfigs returns the configs of the instances to install.
+// The instances listen on ListenPort, ListenPort+1 ... and their Hostname ends with _<name>.
+func InstallConfigs(config *Config) ([]*Config, error) {
+	configs, err := InstanceConfigs(config)
+	if err != nil || config.Instances == nil {
+		return configs, err
+	}
+	basePort, err := strconv.Atoi(config.ListenPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen port: %s", config.ListenPort)
+	}
+	for i, instanceConfig := range configs {
+		instanceConfig.ListenPort = strconv.Itoa(basePort + i)
+		instanceConfig.Hostname = config.Hostname + "_" + instanceConfig.Instance
+		err = listenPortHandler(instanceConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return configs, nil
+}
+
+// stepName returns the name of a step for the instance
+func stepName(config *Config, name string) string {
+	if config.Instance == "" {
+		return name
+	}
+	return name + " [" + config.Instance + "]"
+}
+
+// unpackAgent unpacks the package into the agent directory.
+// The package is unpacked aside and moved into place, a single top directory like
+// zabbix_agentd is dropped, so that our packages and the vendor packages give the same layout.
+func unpackAgent(config *Config, pathConfig *PathConfig) error {
+	stagingDir, srcDir, err := unpackStaging(pathConfig.PackageAbsPath, config.AgentDir)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+	return MoveTree(srcDir, pathConfig.ZabbixAgentDirAbsPath)
+}
+
+// unpackStaging unpacks the archive into a staging directory in parentDir.
+// It returns the staging directory, to be removed by the caller, and the directory
+// holding the files, which is the single top directory of the archive if it has one.
+func unpackStaging(archiveAbsPath string, parentDir string) (string, string, error) {
+	stagingDir, err := os.MkdirTemp(parentDir, ".unpack-")
+	if err != nil {
+		return "", "", err
+	}
+	err = utils.UnpackingFile(archiveAbsPath, stagingDir)
+	if err != nil {
+		os.RemoveAll(stagingDir)
+		return "", "", err
+	}
+	entries, err := os.ReadDir(stagingDir)
+	if err != nil {
+		os.RemoveAll(stagingDir)
+		return "", "", err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		return stagingDir, filepath.Join(stagingDir, entries[0].Name()), nil
+	}
+	return stagingDir, stagingDir, nil
+}
+
+// MoveTree moves the files of srcDir into dstDir, existing files are replaced.
+func MoveTree(srcDir string, dstDir string) error {
+	return filepath.WalkDir(srcDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dstDir, rel)
+		if d.IsDir() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		return os.Rename(path, target)
+	})
+}
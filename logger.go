@@ -3,37 +3,42 @@ package main
 import (
 	"fmt"
 	"os"
-	"strings"
+	"zabbix_agent_installer/utils"
 )
 
-// ReplaceOthers Replace the "\n","\r","\t" to " "
-func ReplaceOthers(s string) string {
-	s = strings.ReplaceAll(s, "\n", " ")
-	s = strings.ReplaceAll(s, "\t", " ")
-	s = strings.ReplaceAll(s, "\r", " ")
-	return s
-}
+// logMaxBackups is the number of rotated log files kept
+const logMaxBackups = 3
 
-// Logger Log messages display
-func Logger(level string, messages ...string) {
-	result := ""
-	level = ReplaceOthers(level)
-	if level == "" {
-		level = "SYSTEM"
+// SetupLogger configures the logger with the -v, -q, -output and -log-* options
+func SetupLogger(config *Config) error {
+	logger := utils.Default()
+	switch config.Output {
+	case TextOutput:
+	case JSONOutput:
+		// Keep stdout for the result document
+		logger.SetOutput(os.Stderr)
+	default:
+		return fmt.Errorf("unknown output: %s", config.Output)
 	}
-	// Replace '\n' to ' '
-	for i := range messages {
-		result += ReplaceOthers(messages[i]) + " "
+	switch {
+	case config.Verbose:
+		logger.SetLevel(utils.DebugLevel)
+	case config.Quiet:
+		logger.SetLevel(utils.WarnLevel)
 	}
-	fmt.Printf("[%s] %s\n", level, result)
-}
-
-// checkError prints an error message and exit if the exit is true
-func checkError(err error, exit bool) {
+	err := logger.SetFormat(config.LogFormat)
 	if err != nil {
-		Logger("ERROR", err.Error())
-		if exit {
-			os.Exit(1)
+		return err
+	}
+	if config.LogFile != "" {
+		logFile, err := ExpandPath(config.LogFile)
+		if err != nil {
+			return err
+		}
+		err = logger.SetFile(logFile, config.LogMaxSize<<20, logMaxBackups)
+		if err != nil {
+			return err
 		}
 	}
+	return nil
 }
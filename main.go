@@ -1,36 +1,84 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"flag"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strings"
+	"time"
 	"zabbix_agent_installer/utils"
 )
 
 // Config represents the configuration.
 type Config struct {
-	ServerIP    string
-	ServerPort  string
-	AgentIP     string
-	AgentUser   string
-	AgentDir    string
-	PackageName string
-	PackageURL  string
-	OSType      string
-	OSArch      string
+	ServerIP         string   `json:"server_ip"`
+	ServerPort       string   `json:"server_port"`
+	AgentIP          string   `json:"agent_ip"`
+	AgentIface       string   `json:"agent_iface"`
+	AgentSubnet      string   `json:"agent_subnet"`
+	Hostname         string   `json:"hostname"`
+	HostMetadata     string   `json:"host_metadata"`
+	HostMetadataItem string   `json:"host_metadata_item"`
+	MetadataFormat   string   `json:"metadata_format"`
+	Tags             []string `json:"tags"`
+	AgentUser        string   `json:"agent_user"`
+	AgentDir         string   `json:"agent_dir"`
+	PackageName      string   `json:"package_name"`
+	PackageURL       string   `json:"package_url"`
+	OSType           string   `json:"os_type"`
+	OSArch           string   `json:"os_arch"`
+	CronSchedule     string   `json:"cron_schedule"`
+	ListenPort       string   `json:"listen_port"`
+	AutoPort         bool     `json:"auto_port"`
+	MultipleAgents   bool     `json:"multiple_agents"`
+	LogFile          string   `json:"log_file"`
+	LogFormat        string   `json:"log_format"`
+	LogMaxSize       int64    `json:"log_max_size"`
+	Verbose          bool     `json:"verbose"`
+	Quiet            bool     `json:"quiet"`
+	Output           string   `json:"output"`
+	Instance         string   `json:"instance"`
+	Instances        []string `json:"instances"`
+	Template         string   `json:"template"`
+	TemplateVars     []string `json:"template_vars"`
+	ConfParams       []string `json:"conf_params"`
+	UserParams       string   `json:"user_params"`
+	BackupName       string   `json:"backup_name"`
+	BackupLogs       bool     `json:"backup_logs"`
+	ListBackups      bool     `json:"list_backups"`
+	TLS              string   `json:"tls"`
+	TLSPSK           string   `json:"-"`
+	TLSPSKIdentity   string   `json:"tls_psk_identity"`
+	TLSCAFile        string   `json:"tls_ca_file"`
+	TLSCertFile      string   `json:"tls_cert_file"`
+	TLSKeyFile       string   `json:"tls_key_file"`
+	APIURL           string   `json:"api_url"`
+	APIToken         string   `json:"-"`
+	APIUser          string   `json:"api_user"`
+	APIPassword      string   `json:"-"`
+	HostGroups       []string `json:"host_groups"`
+	Templates        []string `json:"templates"`
+	Macros           []string `json:"macros"`
+
+	// pskGenerated and pskIdentityDefault are set when -tls-psk and -tls-psk-identity are not given,
+	// the PSK and the identity of the installed agent are kept then
+	pskGenerated       bool
+	pskIdentityDefault bool
 }
 
 type PathConfig struct {
-	PackageAbsPath         string
-	ZabbixAgentDirAbsPath  string
-	ZabbixAgentAbsPath     string
-	ZabbixAgentConfAbsPath string
+	PackageAbsPath             string `json:"package_abs_path"`
+	ZabbixAgentDirAbsPath      string `json:"agent_dir_abs_path"`
+	ZabbixAgentAbsPath         string `json:"agent_abs_path"`
+	ZabbixAgentBinAbsPath      string `json:"agent_bin_abs_path"`
+	ZabbixAgentConfAbsPath     string `json:"agent_conf_abs_path"`
+	ZabbixAgentPSKAbsPath      string `json:"agent_psk_abs_path"`
+	ZabbixAgentTLSCAAbsPath    string `json:"agent_tls_ca_abs_path"`
+	ZabbixAgentTLSCertAbsPath  string `json:"agent_tls_cert_abs_path"`
+	ZabbixAgentTLSKeyAbsPath   string `json:"agent_tls_key_abs_path"`
+	ZabbixAgentIncludeAbsPath  string `json:"agent_include_abs_path"`
+	ZabbixAgentConfBaseAbsPath string `json:"agent_conf_base_abs_path"`
 }
 
 var (
@@ -38,22 +86,36 @@ var (
 	OS_ARCH = "amd64"
 )
 
-const (
-	EXIT     = true
-	CONTINUE = false
-)
+// DefaultListenPort is the port the zabbix agent listens on.
+const DefaultListenPort = "10050"
 
-func ProcessPathConfig(config *Config, pathConfig *PathConfig) error {
+// agentStartTimeout is how long to wait for the started agent to listen
+const agentStartTimeout = 10 * time.Second
+
+// SetAgentPaths computes the agent paths under AgentDir, nothing is created.
+func SetAgentPaths(config *Config, pathConfig *PathConfig) {
 	switch config.OSType {
 	case "linux":
-		pathConfig.ZabbixAgentDirAbsPath = filepath.Join(config.AgentDir, "zabbix_agentd")
+		pathConfig.ZabbixAgentDirAbsPath = filepath.Join(config.AgentDir, AgentDirName(config))
 		pathConfig.ZabbixAgentAbsPath = filepath.Join(pathConfig.ZabbixAgentDirAbsPath, "zabbix_script.sh")
+		pathConfig.ZabbixAgentBinAbsPath = filepath.Join(pathConfig.ZabbixAgentDirAbsPath, "sbin", "zabbix_agentd")
 		pathConfig.ZabbixAgentConfAbsPath = filepath.Join(pathConfig.ZabbixAgentDirAbsPath, "/etc/zabbix_agentd.conf")
 	case "windows":
-		pathConfig.ZabbixAgentDirAbsPath = filepath.Join(config.AgentDir, "zabbix")
+		pathConfig.ZabbixAgentDirAbsPath = filepath.Join(config.AgentDir, AgentDirName(config))
 		pathConfig.ZabbixAgentAbsPath = filepath.Join(pathConfig.ZabbixAgentDirAbsPath, "bin", "zabbix_agentd.exe")
+		pathConfig.ZabbixAgentBinAbsPath = pathConfig.ZabbixAgentAbsPath
 		pathConfig.ZabbixAgentConfAbsPath = filepath.Join(pathConfig.ZabbixAgentDirAbsPath, "conf", "zabbix_agentd.conf")
 	}
+	pathConfig.ZabbixAgentPSKAbsPath = filepath.Join(filepath.Dir(pathConfig.ZabbixAgentConfAbsPath), "zabbix_agentd.psk")
+	pathConfig.ZabbixAgentTLSCAAbsPath = filepath.Join(filepath.Dir(pathConfig.ZabbixAgentConfAbsPath), "zabbix_agentd_ca.crt")
+	pathConfig.ZabbixAgentTLSCertAbsPath = filepath.Join(filepath.Dir(pathConfig.ZabbixAgentConfAbsPath), "zabbix_agentd.crt")
+	pathConfig.ZabbixAgentTLSKeyAbsPath = filepath.Join(filepath.Dir(pathConfig.ZabbixAgentConfAbsPath), "zabbix_agentd.key")
+	pathConfig.ZabbixAgentIncludeAbsPath = filepath.Join(filepath.Dir(pathConfig.ZabbixAgentConfAbsPath), userParamsDirName)
+	pathConfig.ZabbixAgentConfBaseAbsPath = pathConfig.ZabbixAgentConfAbsPath + ".base"
+}
+
+func ProcessPathConfig(config *Config, pathConfig *PathConfig) error {
+	SetAgentPaths(config, pathConfig)
 	fileInfo, err := os.Stat(pathConfig.ZabbixAgentDirAbsPath)
 	if os.IsNotExist(err) {
 		err := os.MkdirAll(pathConfig.ZabbixAgentDirAbsPath, os.ModePerm)
@@ -63,251 +125,475 @@ func ProcessPathConfig(config *Config, pathConfig *PathConfig) error {
 	fileMode := fileInfo.Mode()
 	if fileMode.IsDir() {
 		dir, err := os.ReadDir(pathConfig.ZabbixAgentDirAbsPath)
-		checkError(err, EXIT)
-		// if OS type is windows, stop the process.
+		if err != nil {
+			return err
+		}
+		// if OS type is windows, stop the agent being replaced to unlock its files.
 		if len(dir) != 0 && config.OSType == "windows" {
-			// Stop all zabbix agent
-			_, err = RunWinCommand("taskkill", "/F", "/IM", "zabbix_agentd.exe", "/T")
+			err = stopAgent(config, pathConfig)
 			if err != nil {
-				return fmt.Errorf("path %s already in use", pathConfig.ZabbixAgentDirAbsPath)
+				return fmt.Errorf("path %s already in use: %s", pathConfig.ZabbixAgentDirAbsPath, err.Error())
 			}
 		}
 	}
 	return nil
 }
 
-// NewCronFile Edit the crontab file
-func NewCronFile(cron string) (string, error) {
-	cronAbsPath := filepath.Join(NewCronTempFile(), "")
-	f, err := os.OpenFile(cronAbsPath, os.O_CREATE|(os.O_RDWR|os.O_TRUNC), 0644)
-	defer func() {
-		err = f.Close()
-		if err != nil {
-			fmt.Print(err.Error())
-			return
-		}
-	}()
+// writeConfig renders zabbix_agentd.conf from the -template file or the default template,
+// and writes the PSK file with -tls psk or copies the certificate files with -tls cert
+func writeConfig(config *Config, pathConfig *PathConfig) error {
+	name, text, err := confTemplate(config)
+	if err != nil {
+		return err
+	}
+	switch config.TLS {
+	case TLSPSK:
+		err = writePSK(config, pathConfig)
+	case TLSCert:
+		err = copyTLSFiles(config, pathConfig)
+	}
+	if err != nil {
+		return err
+	}
+	data, err := NewTemplateData(config, pathConfig)
+	if err != nil {
+		return err
+	}
+	conf, err := RenderTemplate(name, text, data)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(pathConfig.ZabbixAgentConfAbsPath), 0755)
 	if err != nil {
-		return "", err
+		return err
 	}
-	_, err = f.WriteString(cron)
+	err = ParseAgentConf(conf).WriteFile(pathConfig.ZabbixAgentConfAbsPath)
 	if err != nil {
-		return "", err
+		return err
 	}
-	return cronAbsPath, nil
+	// The base of the merge with the changes made by hand at the next install
+	return ParseAgentConf(conf).WriteFile(pathConfig.ZabbixAgentConfBaseAbsPath)
 }
 
-// NewCronTempFile Generate a crontab path
-func NewCronTempFile() (absPath string) {
-	randString := RandStringBytes(6)
-	return filepath.Join("/tmp/", "crontab."+randString)
+// readPreviousConf reads the configuration of the installed agent and its base,
+// both are nil if no agent is installed and base is nil if it was installed without one.
+func readPreviousConf(pathConfig *PathConfig) (*AgentConf, *AgentConf, error) {
+	local, err := ReadAgentConf(pathConfig.ZabbixAgentConfAbsPath)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	base, err := ReadAgentConf(pathConfig.ZabbixAgentConfBaseAbsPath)
+	if os.IsNotExist(err) {
+		return local, nil, nil
+	}
+	return local, base, err
 }
 
-func WriteCrontab(cron string) error {
-	// Get the source cron
-	cmd := exec.Command("crontab", "-l")
-	output, _ := cmd.Output()
-	f := bytes.NewReader(output)
-	b := bufio.NewReader(f)
-	isCronExists := 0
-	for {
-		line, err := b.ReadString('\n')
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
-		// Check if the temp file contains the zabbix agent crontab
-		pattern := regexp.MustCompile(`^[^#].*zabbix_agentd`)
-		if pattern.MatchString(line) {
-			isCronExists = 1
-		}
+// mergeConfig keeps the changes made by hand to the previous configuration in the written one
+func mergeConfig(config *Config, local *AgentConf, base *AgentConf, pathConfig *PathConfig) ([]ConfConflict, error) {
+	newConf, err := ReadAgentConf(pathConfig.ZabbixAgentConfAbsPath)
+	if err != nil {
+		return nil, err
+	}
+	merged, conflicts := MergeAgentConf(base, local, newConf)
+	for i := range conflicts {
+		conflicts[i].Instance = config.Instance
+		utils.Warn("parameter changed by hand is replaced", "key", conflicts[i].Key, "local", strings.Join(conflicts[i].Local, ","), "new", strings.Join(conflicts[i].New, ","))
 	}
-	// If the source cron file contains the cron
-	if isCronExists == 1 {
-		return fmt.Errorf("crontab already exists")
+	return conflicts, merged.WriteFile(pathConfig.ZabbixAgentConfAbsPath)
+}
+
+// validateConfig checks the written configuration, and tests it with the agent binary:
+// -T on Zabbix 6.0 and later, -p on older versions, which read the configuration before printing the items.
+func validateConfig(pathConfig *PathConfig) error {
+	conf, err := ReadAgentConf(pathConfig.ZabbixAgentConfAbsPath)
+	if err != nil {
+		return err
 	}
-	// New zabbix_agentd crontab
-	dstCronFileAbsPath, err := NewCronFile(string(output) + cron)
+	err = conf.Validate()
 	if err != nil {
 		return err
 	}
-	// Rewrite the crontab
-	cmd = exec.Command("crontab", dstCronFileAbsPath)
-	_, err = cmd.Output()
+	if IsFileNotExist(pathConfig.ZabbixAgentBinAbsPath) {
+		utils.Debug("no agent binary to test the configuration", "bin", pathConfig.ZabbixAgentBinAbsPath)
+		return nil
+	}
+	_, err = RunCommand(pathConfig.ZabbixAgentBinAbsPath, "-c", pathConfig.ZabbixAgentConfAbsPath, "-T")
+	if err != nil && IsContainsOr(err.Error(), []string{"invalid option", "illegal option", "unrecognized option"}) {
+		_, err = RunCommand(pathConfig.ZabbixAgentBinAbsPath, "-c", pathConfig.ZabbixAgentConfAbsPath, "-p")
+	}
+	return err
+}
+
+// writeScript writes zabbix_script.sh if the package has none, or fills in the agent directory
+func writeScript(config *Config, pathConfig *PathConfig) error {
+	if !IsFileNotExist(pathConfig.ZabbixAgentAbsPath) {
+		return ReplaceString(pathConfig.ZabbixAgentAbsPath, map[string]string{"%change_basepath%": pathConfig.ZabbixAgentDirAbsPath})
+	}
+	data, err := NewTemplateData(config, pathConfig)
 	if err != nil {
 		return err
 	}
-	// Remove the temp crontab file
-	err = os.Remove(dstCronFileAbsPath)
+	script, err := RenderTemplate("zabbix_script.sh", DefaultScriptTemplate, data)
 	if err != nil {
 		return err
 	}
-	return nil
+	return os.WriteFile(pathConfig.ZabbixAgentAbsPath, script, 0755)
 }
 
-func writeConfig(config *Config, pathConfig *PathConfig) error {
-	zabbixDirAbsPath := pathConfig.ZabbixAgentDirAbsPath
-	zabbixConfAbsPath := pathConfig.ZabbixAgentConfAbsPath
-	serverIP := config.ServerIP
-	agentIP := config.AgentIP
-	switch config.OSType {
-	case "linux":
-		confArgsMap := make(map[string]string, 3)
-		confArgsMap["%change_basepath%"] = zabbixDirAbsPath
-		confArgsMap["%change_serverip%"] = serverIP
-		confArgsMap["%change_hostname%"] = agentIP
-		err := ReplaceString(zabbixConfAbsPath, confArgsMap)
+// stopAgent stops the service and the processes of the agent in pathConfig, other agents keep running
+func stopAgent(config *Config, pathConfig *PathConfig) error {
+	err := DetectServiceManager(NewAgentService(config, pathConfig)).Stop()
+	if err != nil {
+		return err
+	}
+	return killAgentProcesses(pathConfig.ZabbixAgentBinAbsPath)
+}
+
+// killAgentProcesses kills the processes started from binAbsPath
+func killAgentProcesses(binAbsPath string) error {
+	for _, p := range GetAgentProcesses(binAbsPath) {
+		utils.Info("stop zabbix agent", "pid", p.Pid)
+		err := p.Kill()
 		if err != nil {
 			return err
 		}
-	case "windows":
-		reMap := map[*regexp.Regexp]string{regexp.MustCompile(`.*ServerActive=.*`): "ServerActive=" + serverIP,
-			regexp.MustCompile(`.*Hostname=.*`): "Hostname=" + agentIP,
+	}
+	return nil
+}
+
+// prepareListenPort makes sure the agent can listen on ListenPort.
+// A port held by the agent being replaced is fine, otherwise another port is picked
+// with -auto-port or after asking, and written into the configuration.
+func prepareListenPort(config *Config, pathConfig *PathConfig) error {
+	port := config.ListenPort
+	if IsPortFree(port) {
+		return nil
+	}
+	owner := "another process"
+	if p := GetPortOwner(port); p != nil {
+		exe, _ := p.Exe()
+		if IsSamePath(exe, pathConfig.ZabbixAgentBinAbsPath) {
+			return nil
 		}
-		f, err := os.OpenFile(zabbixConfAbsPath, os.O_RDONLY, os.ModePerm)
-		if err != nil {
-			return err
+		name, _ := p.Name()
+		owner = fmt.Sprintf("%s(pid:%d)", name, p.Pid)
+	}
+	newPort, err := FindFreePort(port)
+	if err != nil {
+		return fmt.Errorf("port %s is used by %s: %s", port, owner, err.Error())
+	}
+	if !config.AutoPort {
+		// nobody reads a question with -output json
+		if !IsTerminal(os.Stdin) || config.Output == JSONOutput {
+			return Errorf(ValidationError, "port %s is used by %s, use -listen-port or -auto-port", port, owner)
 		}
-		all, err := io.ReadAll(f)
-		if err != nil {
-			return err
+		if !AskYesNo(fmt.Sprintf("port %s is used by %s, listen on %s instead?", port, owner, newPort)) {
+			return Errorf(ValidationError, "port %s is used by %s", port, owner)
 		}
-		result, err := RewriteLines(all, reMap)
-		if err != nil {
-			return err
+	}
+	utils.Warn("listen port is in use, use another port", "port", port, "owner", owner, "new_port", newPort)
+	config.ListenPort = newPort
+	return SetConfParams(pathConfig.ZabbixAgentConfAbsPath, map[string]string{"ListenPort": newPort})
+}
+
+// waitAgentListening waits until the agent listens on ListenPort
+func waitAgentListening(config *Config, pathConfig *PathConfig) error {
+	deadline := time.Now().Add(agentStartTimeout)
+	for {
+		if p := GetPortOwner(config.ListenPort); p != nil {
+			exe, _ := p.Exe()
+			if IsSamePath(exe, pathConfig.ZabbixAgentBinAbsPath) {
+				return nil
+			}
 		}
-		// Write to temp file
-		tempFilePath := filepath.Join(zabbixConfAbsPath + RandStringBytes(6))
-		ft, err := os.OpenFile(tempFilePath, os.O_CREATE|(os.O_RDWR|os.O_TRUNC), os.ModePerm)
-		if err != nil {
-			return err
+		if time.Now().After(deadline) {
+			return fmt.Errorf("zabbix agent is not listening on port %s", config.ListenPort)
 		}
-		_, err = ft.Write(result)
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func startAgent(config *Config, pathConfig *PathConfig) error {
+	// Check the listen port
+	err := prepareListenPort(config, pathConfig)
+	if err != nil {
+		return err
+	}
+
+	if config.OSType == "linux" {
+		// Prepare the startup script
+		err = writeScript(config, pathConfig)
 		if err != nil {
 			return err
 		}
-		// Close src file
-		err = f.Close()
-		if err != nil {
-			return err
+	}
+
+	// Register and start zabbix with the init system or the service control manager
+	service := NewAgentService(config, pathConfig)
+	manager := DetectServiceManager(service)
+	err = manager.Install()
+	if err != nil {
+		return err
+	}
+	utils.Info("manage zabbix agent with "+manager.Name(), "service", service.Name)
+	err = manager.Start()
+	if err != nil {
+		return err
+	}
+
+	// Check the process
+	err = waitAgentListening(config, pathConfig)
+	if err != nil {
+		return err
+	}
+	for _, p := range GetAgentProcesses(pathConfig.ZabbixAgentBinAbsPath) {
+		name, _ := p.Name()
+		utils.Info("zabbix agent is running", "pid", p.Pid, "name", name)
+	}
+	return nil
+}
+
+func main() {
+	os.Exit(run())
+}
+
+// run runs the command and returns the exit code
+func run() int {
+	var config = &Config{}
+	// Read the configuration
+	ReadConfig(config)
+	command, err := ReadCommand()
+	if err == nil {
+		err = SetupLogger(config)
+	}
+	if err != nil {
+		utils.Error(err.Error())
+		return ExitValidation
+	}
+	defer utils.Default().Close()
+	utils.Debug("read config successfully", "command", command)
+	result := NewResult(command, config)
+	code := ExitOK
+	switch command {
+	case "install":
+		err = install(config, result)
+	case "preflight":
+		code = preflight(config, result)
+	case "status":
+		err = status(config, result)
+	case "configure":
+		err = configure(config, result)
+	case "uninstall":
+		err = uninstall(config, result)
+	case "backup":
+		err = backup(config, result)
+	case "restore":
+		err = restore(config, result)
+	default:
+		flag.Usage()
+		err = Errorf(ValidationError, "unknown command: %s", command)
+	}
+	if err != nil {
+		utils.Error(err.Error(), "kind", GetErrorKind(err))
+		code = ExitCode(err)
+	}
+	result.Finish(code, err)
+	if config.Output == JSONOutput {
+		if err := result.Write(os.Stdout); err != nil {
+			utils.Error("write result failed", "error", err)
 		}
-		// Close temp file
-		err = ft.Close()
+	}
+	return code
+}
+
+// install installs and starts the zabbix agent, or each instance of it
+func install(config *Config, result *Result) error {
+	var err error
+	// Read the OS Info
+	err = result.Step("read os info", func() error {
+		return NewError(ValidationError, ReadOSInfo(config))
+	})
+	if err != nil {
+		return err
+	}
+	utils.Info("read OS info successfully", "os", config.OSType, "arch", config.OSArch)
+	// Process configuration
+	var configs []*Config
+	err = result.Step("process config", func() error {
+		err := ProcessConfig(config)
 		if err != nil {
 			return err
 		}
-		// Remove src file,move new file to srr
-		err = os.Remove(zabbixConfAbsPath)
+		configs, err = InstallConfigs(config)
+		return NewError(ValidationError, err)
+	})
+	if err != nil {
+		return err
+	}
+	result.Facts = ReadHostFacts(config)
+	utils.Info("process config successfully", "dir", config.AgentDir, "host_metadata", config.HostMetadata)
+	// Create the agent user when installed by root
+	if IsOtherUser(config.AgentUser) {
+		err = result.Step("create user", func() error {
+			return NewError(ServiceError, CreateSystemUser(config.AgentUser, filepath.Join(config.AgentDir, AgentDirName(config))))
+		})
 		if err != nil {
 			return err
 		}
-		err = os.Rename(tempFilePath, zabbixConfAbsPath)
+		utils.Info("prepare agent user successfully", "user", config.AgentUser)
+	} else {
+		result.Skip("create user")
+	}
+	// Check the package
+	err = result.Step("check package", func() error {
+		info, err := NewPackageInfo(config.PackageName)
+		result.Package = info
+		return NewError(PackageError, err)
+	})
+	if err != nil {
+		return err
+	}
+	for _, instanceConfig := range configs {
+		pathConfig := &PathConfig{PackageAbsPath: config.PackageName}
+		if instanceConfig.Instance == "" {
+			result.PathConfig = pathConfig
+		} else {
+			result.Instances = append(result.Instances, &InstanceResult{Name: instanceConfig.Instance, Config: instanceConfig, PathConfig: pathConfig})
+		}
+		err = installInstance(instanceConfig, pathConfig, result)
 		if err != nil {
 			return err
 		}
+		if instanceConfig.Instance == "" {
+			result.TLS = NewTLSInfo(instanceConfig, pathConfig)
+		} else {
+			result.Instances[len(result.Instances)-1].TLS = NewTLSInfo(instanceConfig, pathConfig)
+		}
 	}
+	utils.Info("zabbix_agent_installer is running done")
 	return nil
 }
-func startAgent(config *Config, pathConfig *PathConfig) error {
-	zabbixDirAbsPath := pathConfig.ZabbixAgentDirAbsPath
-	zabbixConfAbsPath := pathConfig.ZabbixAgentConfAbsPath
-	zabbixAbsPath := pathConfig.ZabbixAgentAbsPath
 
-	switch config.OSType {
-	case "linux":
-		// Modify the startup script
-		rgsMap := make(map[string]string, 1)
-		rgsMap["%change_basepath%"] = zabbixDirAbsPath
-		err := ReplaceString(zabbixAbsPath, rgsMap)
-		if err != nil {
-			return err
+// installInstance unpacks, configures and starts the agent of config
+func installInstance(config *Config, pathConfig *PathConfig, result *Result) error {
+	err := result.Step(stepName(config, "prepare dir"), func() error {
+		return NewError(FilesystemError, ProcessPathConfig(config, pathConfig))
+	})
+	if err != nil {
+		return err
+	}
+	// Read the configuration of the agent being replaced, before the package overwrites it
+	var local, base *AgentConf
+	err = result.Step(stepName(config, "read previous config"), func() error {
+		local, base, err = readPreviousConf(pathConfig)
+		if err == nil {
+			err = reusePSK(config, pathConfig, local)
 		}
-
-		// Start zabbix
-		err = StartAgent(zabbixAbsPath)
+		return NewError(FilesystemError, err)
+	})
+	if err != nil {
+		return err
+	}
+	// Unpacking the package
+	err = result.Step(stepName(config, "unpack package"), func() error {
+		return NewError(PackageError, unpackAgent(config, pathConfig))
+	})
+	if err != nil {
+		return err
+	}
+	utils.Info("unpack file successfully", "package", pathConfig.PackageAbsPath, "dir", pathConfig.ZabbixAgentDirAbsPath)
+	// Write configuration
+	err = result.Step(stepName(config, "write config"), func() error {
+		return NewError(FilesystemError, writeConfig(config, pathConfig))
+	})
+	if err != nil {
+		return err
+	}
+	utils.Info("write config successfully", "conf", pathConfig.ZabbixAgentConfAbsPath)
+	// Keep the changes made by hand since the last install
+	if local != nil {
+		err = result.Step(stepName(config, "merge config"), func() error {
+			conflicts, err := mergeConfig(config, local, base, pathConfig)
+			result.Conflicts = append(result.Conflicts, conflicts...)
+			return NewError(FilesystemError, err)
+		})
 		if err != nil {
 			return err
 		}
-
-		// Check the process
-		p := GetProcess()
-		for pid, name := range p {
-			if strings.Contains(name, "zabbix_agentd") {
-				fmt.Printf("pid:%d, name:%s\n", pid, name)
-			}
-		}
-		// Write the cron
-		cron := "*/10 * * * * /bin/sh /home/test/zabbix_agentd/zabbix_script.sh daemon 2>&1 > /dev/null\n"
-		err = WriteCrontab(cron)
-		if err != nil {
-			Logger("WARN", err.Error())
-		}
-	case "windows":
-		err := os.Chdir(filepath.Join(zabbixDirAbsPath, "\\bin\\"))
+		utils.Info("merge config successfully", "conf", pathConfig.ZabbixAgentConfAbsPath)
+	} else {
+		result.Skip(stepName(config, "merge config"))
+	}
+	// Deploy the UserParameter files and scripts
+	if config.UserParams != "" {
+		err = result.Step(stepName(config, "deploy user parameters"), func() error {
+			return NewError(FilesystemError, deployUserParams(config, pathConfig))
+		})
 		if err != nil {
 			return err
 		}
-		// Uninstall zabbix agent
-		if !IsFileNotExist(zabbixDirAbsPath) {
-			_, err = RunWinCommand(zabbixAbsPath, "-c", zabbixConfAbsPath, "-d")
-			//Logger("INFO", "run:", zabbixDirAbsPath, "-c", zabbixConfAbsPath, "-d")
-			if err != nil {
-				Logger("ERROR", "uninstall zabbix agent failed.", err.Error())
-			} else {
-				Logger("INFO", "uninstall zabbix agent successfully.")
-			}
-		}
-		// Install zabbix agent
-		_, err = RunWinCommand(zabbixAbsPath, "-c", zabbixConfAbsPath, "-i")
-		//Logger("INFO", "run:", zabbixAbsPath, "-c", zabbixConfAbsPath, "-i")
+		utils.Info("deploy user parameters successfully", "dir", pathConfig.ZabbixAgentIncludeAbsPath)
+	} else {
+		result.Skip(stepName(config, "deploy user parameters"))
+	}
+	// Check the configuration before the agent is started with it
+	err = result.Step(stepName(config, "validate config"), func() error {
+		return NewError(ValidationError, validateConfig(pathConfig))
+	})
+	if err != nil {
+		return err
+	}
+	utils.Info("validate config successfully", "conf", pathConfig.ZabbixAgentConfAbsPath)
+	// Hand the agent directory over to the agent user
+	if IsOtherUser(config.AgentUser) {
+		err = result.Step(stepName(config, "change owner"), func() error {
+			return NewError(FilesystemError, ChownR(pathConfig.ZabbixAgentDirAbsPath, config.AgentUser))
+		})
 		if err != nil {
-			Logger("ERROR", "install zabbix agent failed.", err.Error())
-		} else {
-			Logger("INFO", "install zabbix agent successfully.")
+			return err
 		}
-		// Start zabbix agent
-		_, err = RunWinCommand(zabbixAbsPath, "-c", zabbixConfAbsPath, "-s")
-		//Logger("INFO", "run:", zabbixAbsPath, "-c", zabbixConfAbsPath, "-s")
+		utils.Info("change owner successfully", "user", config.AgentUser)
+	} else {
+		result.Skip(stepName(config, "change owner"))
+	}
+	// Start zabbix agent
+	err = result.Step(stepName(config, "start agent"), func() error {
+		return NewError(ServiceError, startAgent(config, pathConfig))
+	})
+	result.AddAgent(config, pathConfig, agentPids(pathConfig.ZabbixAgentBinAbsPath), agentServiceInfo(config, pathConfig), nil)
+	if err != nil {
+		return err
+	}
+	utils.Info("start agent successfully", "instance", config.Instance)
+	// Check the deployed user parameters with the running configuration
+	if config.UserParams != "" {
+		err = result.Step(stepName(config, "test user parameters"), func() error {
+			return NewError(ValidationError, testUserParams(config, pathConfig))
+		})
 		if err != nil {
-			Logger("ERROR", "start zabbix agent failed.", err.Error())
-		} else {
-			Logger("INFO", "start zabbix agent successfully.")
+			return err
 		}
+	} else {
+		result.Skip(stepName(config, "test user parameters"))
+	}
+	// Register the host in zabbix
+	if config.APIURL == "" {
+		result.Skip(stepName(config, "register host"))
+		return nil
+	}
+	var host *HostInfo
+	err = result.Step(stepName(config, "register host"), func() error {
+		host, err = registerHost(config, pathConfig)
+		return NewError(NetworkError, err)
+	})
+	if err != nil {
+		return err
 	}
+	result.AddHost(config, host)
+	utils.Info("register host successfully", "host", host.Host, "hostid", host.HostID, "created", host.Created)
 	return nil
 }
-
-func main() {
-	var err error
-	var config = &Config{}
-	var pathConfig = &PathConfig{}
-	// Read the OS Info
-	err = ReadOSInfo(config)
-	checkError(err, EXIT)
-	Logger("INFO", "read OS info successfully.")
-	// Read the configuration
-	ReadConfig(config)
-	Logger("INFO", "read config successfully.")
-	// Process configuration
-	err = ProcessConfig(config)
-	checkError(err, EXIT)
-	err = ProcessPathConfig(config, pathConfig)
-	checkError(err, EXIT)
-	Logger("INFO", "process config successfully.")
-	// Check the package
-	pathConfig.PackageAbsPath = filepath.Join(config.AgentDir, config.PackageName)
-	// Unpacking the package
-	err = utils.UnpackingFile(pathConfig.PackageAbsPath, config.AgentDir)
-	checkError(err, EXIT)
-	Logger("INFO", "unpack file successfully.")
-	// Write configuration
-	err = writeConfig(config, pathConfig)
-	checkError(err, EXIT)
-	Logger("INFO", "write config successfully.")
-	// Start zabbix agent
-	err = startAgent(config, pathConfig)
-	checkError(err, EXIT)
-	Logger("INFO", "start agent successfully.")
-	Logger("INFO", "zabbix_agent_installer is running done.")
-}
@@ -9,10 +9,15 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	psnet "github.com/shirou/gopsutil/net"
+	"github.com/shirou/gopsutil/process"
 	"golang.org/x/net/html"
+	"zabbix_agent_installer/utils"
 )
 
 // Determine whether the IP is compliant
@@ -25,29 +30,209 @@ func IsIPv4(ipv4 string) bool {
 	return ip != nil
 }
 
-// Test if the IP is reachable
-func IsUnreachable(ipv4 string, port string) bool {
-	addr := net.JoinHostPort(ipv4, port)
-	conn, err := net.DialTimeout("tcp", addr, 1*time.Second)
-	if err != nil {
+// IsIPv6 returns true if the address is an IPv6 literal
+func IsIPv6(ipv6 string) bool {
+	ip := net.ParseIP(ipv6)
+	return ip != nil && ip.To4() == nil
+}
+
+// dnsNameRegexp matches a DNS name like zabbix-proxy.dc1.example.com
+var dnsNameRegexp = regexp.MustCompile(`^([0-9A-Za-z]([0-9A-Za-z-]{0,61}[0-9A-Za-z])?)(\.[0-9A-Za-z]([0-9A-Za-z-]{0,61}[0-9A-Za-z])?)*\.?$`)
+
+// IsHostAddress returns true if the address is an IPv4 or IPv6 literal or a DNS name
+func IsHostAddress(address string) bool {
+	if net.ParseIP(address) != nil {
 		return true
 	}
-	defer conn.Close()
-	return false
+	return len(address) <= 253 && dnsNameRegexp.MatchString(address)
+}
+
+// TrimBrackets removes the brackets around an IPv6 literal, like [::1]
+func TrimBrackets(address string) string {
+	if strings.HasPrefix(address, "[") && strings.HasSuffix(address, "]") {
+		return address[1 : len(address)-1]
+	}
+	return address
+}
+
+// FormatServerActive returns the ServerActive value of host and port,
+// IPv6 literals are bracketed like [::1]:10051.
+func FormatServerActive(host string, port string) string {
+	if port == "" {
+		if IsIPv6(host) {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// ProbeHost resolves the host and connects to port on every address.
+// It returns the reachable addresses and the errors of the others.
+func ProbeHost(host string, port string) ([]string, []error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, []error{err}
+	}
+	var reachable []string
+	var errs []error
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), port)
+		conn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		conn.Close()
+		reachable = append(reachable, addr)
+	}
+	return reachable, errs
+}
+
+// Test if the host is reachable on any of its addresses
+func IsUnreachable(host string, port string) bool {
+	reachable, _ := ProbeHost(host, port)
+	return len(reachable) == 0
 }
 
-// GetMainIP gets the IP address of the host.
-func GetMainIP() (string, error) {
-	conn, err := net.Dial("udp", "8.8.8.8:53")
+// IsPortFree returns true if nothing listens on the tcp port
+func IsPortFree(port string) bool {
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// GetPortOwner returns the process listening on the tcp port, nil if there is none or it is unknown
+func GetPortOwner(port string) *process.Process {
+	p, err := strconv.ParseUint(port, 10, 32)
+	if err != nil {
+		return nil
+	}
+	conns, err := psnet.Connections("tcp")
+	if err != nil {
+		return nil
+	}
+	for _, conn := range conns {
+		if conn.Status == "LISTEN" && conn.Laddr.Port == uint32(p) && conn.Pid != 0 {
+			owner, err := process.NewProcess(conn.Pid)
+			if err != nil {
+				return nil
+			}
+			return owner
+		}
+	}
+	return nil
+}
+
+// FindFreePort returns the first free tcp port after port
+func FindFreePort(port string) (string, error) {
+	start, err := strconv.Atoi(port)
+	if err != nil {
+		return "", fmt.Errorf("invalid port: %s", port)
+	}
+	for p := start + 1; p <= 65535 && p <= start+100; p++ {
+		if IsPortFree(strconv.Itoa(p)) {
+			return strconv.Itoa(p), nil
+		}
+	}
+	return "", fmt.Errorf("no free port found after %s", port)
+}
+
+// GetMainIP gets the IP address of the host used to reach the target.
+// No packet is sent, the routing table picks the source address.
+func GetMainIP(host string, port string) (string, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(host, port))
 	if err != nil {
 		return "", err
 	}
 	defer conn.Close()
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	if localAddr.String() == "" {
+	if localAddr.IP == nil {
 		return "", errors.New("no local address")
 	}
-	return strings.Split(localAddr.String(), ":")[0], nil
+	return localAddr.IP.String(), nil
+}
+
+// GetInterfaceIP gets the first IPv4 address of the network interface,
+// or its first global IPv6 address if it has no IPv4 address.
+func GetInterfaceIP(name string) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.String(), nil
+		}
+	}
+	// IPv6 only interface
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+			return ipNet.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no address on interface %s", name)
+}
+
+// GetSubnetIP gets the first address of the host in the subnet, like 10.0.0.0/8.
+func GetSubnetIP(cidr string) (string, error) {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && subnet.Contains(ipNet.IP) {
+			return ipNet.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no address in subnet %s", cidr)
+}
+
+// GetFQDN gets the fully qualified domain name of the host,
+// the short hostname if it can not be resolved.
+func GetFQDN() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(hostname, ".") {
+		return hostname, nil
+	}
+	addrs, _ := net.LookupHost(hostname)
+	for _, addr := range addrs {
+		names, _ := net.LookupAddr(addr)
+		for _, name := range names {
+			name = strings.TrimSuffix(name, ".")
+			if strings.HasPrefix(name, hostname+".") {
+				return name, nil
+			}
+		}
+	}
+	cname, err := net.LookupCNAME(hostname)
+	if err == nil && strings.Contains(strings.TrimSuffix(cname, "."), ".") {
+		return strings.TrimSuffix(cname, "."), nil
+	}
+	return hostname, nil
+}
+
+// GetShortHostname gets the hostname without the domain.
+func GetShortHostname() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return strings.Split(hostname, ".")[0], nil
 }
 
 func visit(links []string, n *html.Node) []string {
@@ -79,6 +264,8 @@ func GetLinks(url string) ([]string, error) {
 	return links, nil
 }
 
+// DownloadPackage saves the package at url into saveAbsPath and returns its file name.
+// An HTTP error status or an interrupted download is an error and leaves no file.
 func DownloadPackage(url string, saveAbsPath string) (string, error) {
 	resp, err := http.Get(url)
 	if err != nil {
@@ -87,24 +274,27 @@ func DownloadPackage(url string, saveAbsPath string) (string, error) {
 	defer func() {
 		err := resp.Body.Close()
 		if err != nil {
-			fmt.Print(err.Error())
+			utils.Warn("close response failed", "url", url, "error", err)
 		}
 	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download %s failed: %s", url, resp.Status)
+	}
 	// Create a file and get the filename from the url
 	filename := path.Base(url)
-	out, err := os.OpenFile(filepath.Join(saveAbsPath, filename), os.O_CREATE|os.O_RDWR, 0755)
+	fileAbsPath := filepath.Join(saveAbsPath, filename)
+	out, err := os.OpenFile(fileAbsPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0755)
 	if err != nil {
 		return "", err
 	}
-	defer func() {
-		err := out.Close()
-		if err != nil {
-			fmt.Print(err.Error())
-		}
-	}()
+	utils.Debug("download package", "url", url, "file", fileAbsPath)
 	_, err = io.Copy(out, resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		fmt.Print(err.Error())
+		os.Remove(fileAbsPath)
+		return "", fmt.Errorf("download %s failed: %s", url, err.Error())
 	}
 	return filename, nil
 }
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"zabbix_agent_installer/utils"
 
+	"github.com/shirou/gopsutil/disk"
 	"github.com/shirou/gopsutil/process"
 )
 
@@ -21,17 +30,18 @@ func GetFileNames(absPath string) ([]string, error) {
 	return myFiles, nil
 }
 
-// IsFileNotExist returns true if the given file exists,otherwise returns false.
+// IsFileNotExist returns true if the file does not exist. A file which cannot be read,
+// like one in a directory without permission, is reported and taken as existing.
 func IsFileNotExist(fileAbsPath string) bool {
-	fileInfo, err := os.Stat(fileAbsPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return true
-		}
-	}
-	if fileInfo.IsDir() {
+	_, err := os.Stat(fileAbsPath)
+	if err == nil {
 		return false
 	}
+	// a file as parent directory: the path does not exist
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+		return true
+	}
+	utils.Warn("check file failed", "file", fileAbsPath, "error", err)
 	return false
 }
 
@@ -46,3 +56,95 @@ func GetProcess() map[int32]string {
 	}
 	return p
 }
+
+// GetAgentProcesses returns the running processes started from binAbsPath
+func GetAgentProcesses(binAbsPath string) []*process.Process {
+	var agents []*process.Process
+	processes, _ := process.Processes()
+	for _, p := range processes {
+		exe, err := p.Exe()
+		if err == nil && IsSamePath(exe, binAbsPath) {
+			agents = append(agents, p)
+			continue
+		}
+		cmdline, err := p.CmdlineSlice()
+		if err == nil && len(cmdline) > 0 && IsSamePath(cmdline[0], binAbsPath) {
+			agents = append(agents, p)
+		}
+	}
+	return agents
+}
+
+// IsSamePath returns true if both paths name the same file, ignoring the case on windows.
+// Existing files reached through a symlink are the same file as well.
+func IsSamePath(a string, b string) bool {
+	if a == "" || b == "" {
+		return a == b
+	}
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	if a == b || runtime.GOOS == "windows" && strings.EqualFold(a, b) {
+		return true
+	}
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	return err == nil && os.SameFile(infoA, infoB)
+}
+
+// ExpandPath expands a leading ~ to the home of the current user and the environment variables.
+func ExpandPath(path string) (string, error) {
+	path = os.ExpandEnv(path)
+	if path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, "~\\") {
+		home, err := GetUserHomePath()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(home, path[1:])
+	}
+	return filepath.Abs(path)
+}
+
+// CheckWritable returns an error if the current user can not create files in dirAbsPath
+func CheckWritable(dirAbsPath string) error {
+	f, err := os.CreateTemp(dirAbsPath, ".zabbix_agent_installer")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %s", dirAbsPath, err.Error())
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(f.Name())
+}
+
+// GetFreeSpace returns the free bytes of the filesystem containing absPath
+func GetFreeSpace(absPath string) (uint64, error) {
+	usage, err := disk.Usage(absPath)
+	if err != nil {
+		return 0, err
+	}
+	return usage.Free, nil
+}
+
+// IsTerminal returns true if f is a terminal, so the user can be asked
+func IsTerminal(f *os.File) bool {
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fileInfo.Mode()&os.ModeCharDevice != 0
+}
+
+// AskYesNo asks the question on the terminal and returns true if the answer is yes.
+// The question goes to stderr, stdout is kept for the output of the command.
+func AskYesNo(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
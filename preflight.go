@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"zabbix_agent_installer/utils"
+)
+
+// CheckStatus is the outcome of a pre-flight check.
+type CheckStatus int
+
+const (
+	CheckPass CheckStatus = iota
+	CheckWarn
+	CheckFail
+	// CheckSkip is a check which could not be run, it does not change the exit code
+	CheckSkip
+)
+
+func (s CheckStatus) String() string {
+	switch s {
+	case CheckPass:
+		return "PASS"
+	case CheckWarn:
+		return "WARN"
+	case CheckSkip:
+		return "SKIP"
+	}
+	return "FAIL"
+}
+
+const (
+	// minFreeSpace is the free space wanted when the package size is unknown.
+	minFreeSpace = 100 << 20
+	// maxClockSkew is the largest clock difference to the server without a warning.
+	maxClockSkew = 60 * time.Second
+)
+
+// MarshalText writes the status in lower case.
+func (s CheckStatus) MarshalText() ([]byte, error) {
+	return []byte(strings.ToLower(s.String())), nil
+}
+
+// CheckResult is the result of a pre-flight check.
+type CheckResult struct {
+	Name   string      `json:"name"`
+	Status CheckStatus `json:"status"`
+	Detail string      `json:"detail"`
+}
+
+// preflight runs the pre-flight checks, prints the report and returns the exit code
+func preflight(config *Config, result *Result) int {
+	results := RunPreflight(config)
+	result.Checks = results
+	PrintPreflight(textOutput(config), results)
+	return PreflightExitCode(results)
+}
+
+// RunPreflight checks whether the agent can be installed with config.
+// Nothing is changed on the system.
+func RunPreflight(config *Config) []CheckResult {
+	var results []CheckResult
+	results = append(results, checkOS(config))
+	results = append(results, checkAgentUser(config))
+	dir, err := ResolveAgentDir(config)
+	if err != nil {
+		results = append(results, CheckResult{"agent dir", CheckFail, err.Error()})
+	} else {
+		config.AgentDir = dir
+		results = append(results, checkAgentDir(config))
+		results = append(results, checkDiskSpace(config))
+	}
+	results = append(results, checkServer(config))
+	results = append(results, checkListenPort(config.ListenPort))
+	results = append(results, checkRunningAgent())
+	results = append(results, checkSupervisor(config))
+	results = append(results, checkClock(config))
+	results = append(results, checkSecurityModule(config))
+	return results
+}
+
+// PrintPreflight prints the results as a table.
+func PrintPreflight(w io.Writer, results []CheckResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tSTATUS\tDETAIL")
+	for _, result := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", result.Name, result.Status, result.Detail)
+	}
+	tw.Flush()
+}
+
+// PreflightExitCode returns the exit code of the worst result.
+func PreflightExitCode(results []CheckResult) int {
+	code := ExitOK
+	for _, result := range results {
+		switch result.Status {
+		case CheckFail:
+			return ExitFailure
+		case CheckWarn:
+			code = ExitWarning
+		}
+	}
+	return code
+}
+
+// nearestExistingDir returns absPath or its closest existing parent
+func nearestExistingDir(absPath string) string {
+	for dir := absPath; ; dir = filepath.Dir(dir) {
+		if ok, _ := utils.PathExists(dir); ok || filepath.Dir(dir) == dir {
+			return dir
+		}
+	}
+}
+
+func checkOS(config *Config) CheckResult {
+	err := ReadOSInfo(config)
+	if err != nil {
+		return CheckResult{"os", CheckFail, fmt.Sprintf("%s/%s: %s", config.OSType, config.OSArch, err.Error())}
+	}
+	detail := config.OSType + "/" + config.OSArch
+	switch config.OSArch {
+	case "amd64", "386", "arm64", "arm":
+	default:
+		return CheckResult{"os", CheckWarn, detail + ": no agent package for this arch"}
+	}
+	if config.OSType == "linux" {
+		name, version := utils.GetLinuxVersion()
+		if name == "" {
+			return CheckResult{"os", CheckWarn, detail + ": unknown distribution"}
+		}
+		detail += " " + name + " " + version
+	}
+	return CheckResult{"os", CheckPass, detail}
+}
+
+func checkAgentUser(config *Config) CheckResult {
+	err := agentUserHandler(config)
+	if err != nil {
+		return CheckResult{"agent user", CheckFail, err.Error()}
+	}
+	if config.AgentUser == "" {
+		return CheckResult{"agent user", CheckPass, "current user"}
+	}
+	return CheckResult{"agent user", CheckPass, config.AgentUser}
+}
+
+func checkAgentDir(config *Config) CheckResult {
+	dir := nearestExistingDir(config.AgentDir)
+	err := CheckWritable(dir)
+	if err != nil {
+		return CheckResult{"agent dir", CheckFail, err.Error()}
+	}
+	if IsOtherUser(config.AgentUser) {
+		err = CheckUserAccess(dir, config.AgentUser)
+		if err != nil {
+			return CheckResult{"agent dir", CheckFail, err.Error()}
+		}
+	}
+	return CheckResult{"agent dir", CheckPass, config.AgentDir}
+}
+
+func checkDiskSpace(config *Config) CheckResult {
+	free, err := GetFreeSpace(nearestExistingDir(config.AgentDir))
+	if err != nil {
+		return CheckResult{"disk space", CheckWarn, err.Error()}
+	}
+	var need uint64 = minFreeSpace
+	if config.PackageName != "" {
+		size, err := utils.UnpackedSize(config.PackageName)
+		if err != nil {
+			return CheckResult{"disk space", CheckFail, err.Error()}
+		}
+		need = size
+	}
+	detail := fmt.Sprintf("%d MiB free, %d MiB needed", free>>20, need>>20)
+	if free < need {
+		if config.PackageName != "" {
+			return CheckResult{"disk space", CheckFail, detail}
+		}
+		return CheckResult{"disk space", CheckWarn, detail}
+	}
+	return CheckResult{"disk space", CheckPass, detail}
+}
+
+func checkServer(config *Config) CheckResult {
+	err := serverIPHandler(config)
+	if err != nil {
+		return CheckResult{"server", CheckFail, err.Error()}
+	}
+	addr := net.JoinHostPort(config.ServerIP, config.ServerPort)
+	reachable, errs := ProbeHost(config.ServerIP, config.ServerPort)
+	if len(reachable) == 0 {
+		return CheckResult{"server", CheckWarn, "connect to " + addr + " failed"}
+	}
+	if len(errs) != 0 {
+		return CheckResult{"server", CheckWarn, fmt.Sprintf("%s reachable, %d other addresses unreachable", strings.Join(reachable, ","), len(errs))}
+	}
+	return CheckResult{"server", CheckPass, strings.Join(reachable, ",") + " reachable"}
+}
+
+func checkListenPort(port string) CheckResult {
+	if !IsPortFree(port) {
+		if p := GetPortOwner(port); p != nil {
+			name, _ := p.Name()
+			return CheckResult{"listen port", CheckWarn, fmt.Sprintf("port %s in use by %s(pid:%d)", port, name, p.Pid)}
+		}
+		return CheckResult{"listen port", CheckWarn, "port " + port + " in use"}
+	}
+	return CheckResult{"listen port", CheckPass, "port " + port + " free"}
+}
+
+func checkRunningAgent() CheckResult {
+	var pids []string
+	for pid, name := range GetProcess() {
+		if strings.Contains(name, "zabbix_agentd") {
+			pids = append(pids, fmt.Sprint(pid))
+		}
+	}
+	if len(pids) != 0 {
+		return CheckResult{"running agent", CheckWarn, "zabbix_agentd running, pid " + strings.Join(pids, ",")}
+	}
+	return CheckResult{"running agent", CheckPass, "none"}
+}
+
+func checkSupervisor(config *Config) CheckResult {
+	if config.OSType == "windows" {
+		return CheckResult{"supervisor", CheckPass, "windows service"}
+	}
+	pathConfig := &PathConfig{ZabbixAgentDirAbsPath: filepath.Join(config.AgentDir, "zabbix_agentd")}
+	manager := DetectServiceManager(NewAgentService(config, pathConfig))
+	if manager.Name() == "crontab" && !IsCommandExist("crontab") {
+		return CheckResult{"supervisor", CheckFail, "no init system usable and crontab not found"}
+	}
+	return CheckResult{"supervisor", CheckPass, manager.Name()}
+}
+
+// checkClock checks that the clock is synchronized with timedatectl. Without timedatectl the clock
+// is compared with the Date header of the web frontend on the server, the check is skipped if
+// there is none.
+func checkClock(config *Config) CheckResult {
+	if IsCommandExist("timedatectl") {
+		out, err := RunCommand("timedatectl", "show", "-p", "NTPSynchronized", "--value")
+		switch {
+		case err == nil && out == "yes":
+			return CheckResult{"clock", CheckPass, "synchronized"}
+		case err == nil && out == "no":
+			return CheckResult{"clock", CheckWarn, "not synchronized, check the NTP service"}
+		}
+		// timedatectl before systemd 239 has no show command
+	}
+	if config.ServerIP == "" {
+		return CheckResult{"clock", CheckSkip, "no time source"}
+	}
+	client := &http.Client{Timeout: 3 * time.Second}
+	resp, err := client.Head("http://" + net.JoinHostPort(config.ServerIP, "80") + "/")
+	if err != nil {
+		return CheckResult{"clock", CheckSkip, "no time source, no web frontend on " + config.ServerIP}
+	}
+	resp.Body.Close()
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return CheckResult{"clock", CheckSkip, "no time source, no Date header from " + config.ServerIP}
+	}
+	skew := time.Since(serverTime).Round(time.Second)
+	if skew < 0 {
+		skew = -skew
+	}
+	detail := fmt.Sprintf("skew %s", skew)
+	if skew > maxClockSkew {
+		return CheckResult{"clock", CheckWarn, detail}
+	}
+	return CheckResult{"clock", CheckPass, detail}
+}
+
+func checkSecurityModule(config *Config) CheckResult {
+	if config.OSType != "linux" {
+		return CheckResult{"security module", CheckPass, "none"}
+	}
+	var modules []string
+	if enforce, err := os.ReadFile("/sys/fs/selinux/enforce"); err == nil {
+		if strings.TrimSpace(string(enforce)) == "1" {
+			return CheckResult{"security module", CheckWarn, "SELinux enforcing, the agent may be denied outside of system paths"}
+		}
+		modules = append(modules, "SELinux permissive")
+	}
+	if enabled, err := os.ReadFile("/sys/module/apparmor/parameters/enabled"); err == nil && strings.TrimSpace(string(enabled)) == "Y" {
+		modules = append(modules, "AppArmor enabled")
+	}
+	if len(modules) == 0 {
+		return CheckResult{"security module", CheckPass, "none"}
+	}
+	return CheckResult{"security module", CheckPass, strings.Join(modules, ", ")}
+}
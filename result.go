@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"zabbix_agent_installer/utils"
+)
+
+// Output formats of the result
+const (
+	TextOutput = "text"
+	JSONOutput = "json"
+)
+
+// textOutput returns where the human readable output goes, it is discarded with -output json
+// so that the result is the only document on stdout.
+func textOutput(config *Config) io.Writer {
+	if config.Output == JSONOutput {
+		return io.Discard
+	}
+	return os.Stdout
+}
+
+// Step statuses
+const (
+	StepOK      = "ok"
+	StepFailed  = "failed"
+	StepSkipped = "skipped"
+)
+
+// Result is the outcome of a command, printed as a JSON document with -output json.
+// All commands share the schema, sections a command does not fill are omitted.
+type Result struct {
+	Command    string            `json:"command"`
+	Success    bool              `json:"success"`
+	ExitCode   int               `json:"exit_code"`
+	Error      *ResultError      `json:"error,omitempty"`
+	StartTime  time.Time         `json:"start_time"`
+	DurationMs int64             `json:"duration_ms"`
+	Config     *Config           `json:"config"`
+	PathConfig *PathConfig       `json:"path_config,omitempty"`
+	Package    *PackageInfo      `json:"package,omitempty"`
+	Facts      *HostFacts        `json:"facts,omitempty"`
+	TLS        *TLSInfo          `json:"tls,omitempty"`
+	Host       *HostInfo         `json:"host,omitempty"`
+	Steps      []StepResult      `json:"steps"`
+	Checks     []CheckResult     `json:"checks,omitempty"`
+	Pids       []int32           `json:"pids"`
+	Service    *ServiceInfo      `json:"service,omitempty"`
+	Agent      *AgentStatus      `json:"agent,omitempty"`
+	Diff       []string          `json:"diff,omitempty"`
+	Conflicts  []ConfConflict    `json:"conflicts,omitempty"`
+	Backups    []*BackupInfo     `json:"backups,omitempty"`
+	Instances  []*InstanceResult `json:"instances,omitempty"`
+	Warnings   []string          `json:"warnings"`
+}
+
+// InstanceResult is the outcome of a command for an agent instance.
+type InstanceResult struct {
+	Name       string       `json:"name"`
+	Config     *Config      `json:"config"`
+	PathConfig *PathConfig  `json:"path_config"`
+	Pids       []int32      `json:"pids"`
+	Service    *ServiceInfo `json:"service,omitempty"`
+	Agent      *AgentStatus `json:"agent,omitempty"`
+	TLS        *TLSInfo     `json:"tls,omitempty"`
+	Host       *HostInfo    `json:"host,omitempty"`
+}
+
+// ResultError is the error which made the command fail.
+type ResultError struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// StepResult is the outcome of a step of the command.
+type StepResult struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// PackageInfo describes the installed package.
+type PackageInfo struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Version  string `json:"version"`
+	Checksum string `json:"checksum"`
+}
+
+// ServiceInfo describes how the agent is registered with the system.
+type ServiceInfo struct {
+	Manager   string `json:"manager"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	CronEntry string `json:"cron_entry,omitempty"`
+}
+
+// NewResult starts the result of the command, warnings logged from now on are collected.
+func NewResult(command string, config *Config) *Result {
+	result := &Result{
+		Command:   command,
+		StartTime: time.Now(),
+		Config:    config,
+		Steps:     []StepResult{},
+		Pids:      []int32{},
+		Warnings:  []string{},
+	}
+	utils.Default().AddHook(func(level utils.Level, msg string, fields ...interface{}) {
+		if level == utils.WarnLevel {
+			result.Warnings = append(result.Warnings, warningText(msg, fields))
+		}
+	})
+	return result
+}
+
+// warningText joins the message and its fields like the text log format
+func warningText(msg string, fields []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		value := fields[i+1]
+		if err, ok := value.(error); ok && err != nil {
+			value = err.Error()
+		}
+		fmt.Fprintf(&b, " %v=%v", fields[i], value)
+	}
+	return b.String()
+}
+
+// Step runs fn as the named step and records its status and duration.
+func (r *Result) Step(name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	step := StepResult{Name: name, Status: StepOK, DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		step.Status = StepFailed
+		step.Error = err.Error()
+	}
+	r.Steps = append(r.Steps, step)
+	return err
+}
+
+// Skip records a step which was not needed.
+func (r *Result) Skip(name string) {
+	r.Steps = append(r.Steps, StepResult{Name: name, Status: StepSkipped})
+}
+
+// AddAgent records the processes, service and status of the agent of config.
+// The agent without instance name fills the top level, the pids of every instance are added to Pids.
+func (r *Result) AddAgent(config *Config, pathConfig *PathConfig, pids []int32, service *ServiceInfo, agent *AgentStatus) {
+	r.Pids = append(r.Pids, pids...)
+	if config.Instance == "" {
+		r.PathConfig = pathConfig
+		r.Service = service
+		r.Agent = agent
+		return
+	}
+	for _, instance := range r.Instances {
+		if instance.Name == config.Instance {
+			instance.PathConfig, instance.Pids, instance.Service, instance.Agent = pathConfig, pids, service, agent
+			return
+		}
+	}
+	r.Instances = append(r.Instances, &InstanceResult{Name: config.Instance, Config: config, PathConfig: pathConfig, Pids: pids, Service: service, Agent: agent})
+}
+
+// AddHost records the host registered in zabbix for the agent of config.
+func (r *Result) AddHost(config *Config, host *HostInfo) {
+	if config.Instance == "" {
+		r.Host = host
+		return
+	}
+	for _, instance := range r.Instances {
+		if instance.Name == config.Instance {
+			instance.Host = host
+		}
+	}
+}
+
+// Finish records the exit code and the error of the command.
+func (r *Result) Finish(code int, err error) {
+	r.ExitCode = code
+	r.Success = code == ExitOK || code == ExitWarning
+	r.DurationMs = time.Since(r.StartTime).Milliseconds()
+	if err != nil {
+		r.Error = &ResultError{Kind: GetErrorKind(err).String(), Message: err.Error()}
+	}
+}
+
+// Write writes the result as an indented JSON document.
+func (r *Result) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// packageVersionRegexp matches the version in a package name like zabbix_agent-6.0.13-linux-3.0-amd64-static.tar.gz
+var packageVersionRegexp = regexp.MustCompile(`\d+\.\d+(\.\d+)?`)
+
+// NewPackageInfo reads the name, version and sha256 checksum of the package.
+func NewPackageInfo(packageAbsPath string) (*PackageInfo, error) {
+	f, err := os.Open(packageAbsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(packageAbsPath)
+	return &PackageInfo{
+		Name:     name,
+		Path:     packageAbsPath,
+		Version:  packageVersionRegexp.FindString(name),
+		Checksum: "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// NewServiceInfo reads the registration of the agent managed by manager.
+func NewServiceInfo(manager ServiceManager, service *AgentService) *ServiceInfo {
+	// Status finds the name of the installed service
+	status, err := manager.Status()
+	if err != nil {
+		utils.Debug("read service status failed", "service", service.Name, "error", err)
+	}
+	info := &ServiceInfo{Manager: manager.Name(), Name: service.Name}
+	info.Status = status.String()
+	if manager.Name() == "crontab" {
+		info.CronEntry, _, _ = FindCronEntry(service.User, service.ScriptPath)
+	}
+	return info
+}
+
+// agentServiceInfo reads the registration of the agent described by config
+func agentServiceInfo(config *Config, pathConfig *PathConfig) *ServiceInfo {
+	service := NewAgentService(config, pathConfig)
+	return NewServiceInfo(DetectServiceManager(service), service)
+}
+
+// agentPids returns the pids of the agent started from binAbsPath
+func agentPids(binAbsPath string) []int32 {
+	pids := []int32{}
+	for _, p := range GetAgentProcesses(binAbsPath) {
+		pids = append(pids, p.Pid)
+	}
+	return pids
+}
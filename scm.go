@@ -0,0 +1,54 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var errNoSCM = errors.New("windows service control manager: not supported on this OS")
+
+// scmServiceAPI is not supported outside windows.
+type scmServiceAPI struct{}
+
+// NewSCMServiceAPI returns the service control manager of windows.
+func NewSCMServiceAPI() WinServiceAPI {
+	return scmServiceAPI{}
+}
+
+func (scmServiceAPI) Exists(name string) (bool, error) {
+	return false, errNoSCM
+}
+
+func (scmServiceAPI) Create(name string, displayName string, exePath string, args ...string) error {
+	return errNoSCM
+}
+
+func (scmServiceAPI) Update(name string, displayName string, exePath string, args ...string) error {
+	return errNoSCM
+}
+
+func (scmServiceAPI) Delete(name string) error {
+	return errNoSCM
+}
+
+func (scmServiceAPI) Start(name string) error {
+	return errNoSCM
+}
+
+func (scmServiceAPI) Stop(name string, timeout time.Duration) error {
+	return errNoSCM
+}
+
+func (scmServiceAPI) Query(name string) (ServiceStatus, error) {
+	return ServiceUnknown, errNoSCM
+}
+
+func (scmServiceAPI) List() ([]string, error) {
+	return nil, errNoSCM
+}
+
+func (scmServiceAPI) BinaryPath(name string) (string, error) {
+	return "", errNoSCM
+}
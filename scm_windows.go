@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// scmServiceAPI controls the services with the windows service control manager.
+type scmServiceAPI struct{}
+
+// NewSCMServiceAPI returns the service control manager of windows.
+func NewSCMServiceAPI() WinServiceAPI {
+	return scmServiceAPI{}
+}
+
+// openService connects to the service control manager and opens the service
+func openService(name string) (*mgr.Mgr, *mgr.Service, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := m.OpenService(name)
+	if err != nil {
+		m.Disconnect()
+		return nil, nil, fmt.Errorf("open service %s: %w", name, err)
+	}
+	return m, s, nil
+}
+
+func (scmServiceAPI) Exists(name string) (bool, error) {
+	m, s, err := openService(name)
+	if errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer m.Disconnect()
+	s.Close()
+	return true, nil
+}
+
+func (scmServiceAPI) Create(name string, displayName string, exePath string, args ...string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.CreateService(name, exePath, mgr.Config{
+		DisplayName: displayName,
+		Description: "Provides system monitoring",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("create service %s: %w", name, err)
+	}
+	return s.Close()
+}
+
+func (scmServiceAPI) Update(name string, displayName string, exePath string, args ...string) error {
+	m, s, err := openService(name)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	config, err := s.Config()
+	if err != nil {
+		return fmt.Errorf("read config of service %s: %w", name, err)
+	}
+	// Quoted like mgr.CreateService does
+	config.BinaryPathName = syscall.EscapeArg(exePath)
+	for _, arg := range args {
+		config.BinaryPathName += " " + syscall.EscapeArg(arg)
+	}
+	config.DisplayName = displayName
+	config.StartType = mgr.StartAutomatic
+	err = s.UpdateConfig(config)
+	if err != nil {
+		return fmt.Errorf("update service %s: %w", name, err)
+	}
+	return nil
+}
+
+func (scmServiceAPI) Delete(name string) error {
+	m, s, err := openService(name)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	err = s.Delete()
+	if err != nil {
+		return fmt.Errorf("delete service %s: %w", name, err)
+	}
+	return nil
+}
+
+func (scmServiceAPI) Start(name string) error {
+	m, s, err := openService(name)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	err = s.Start()
+	if err != nil {
+		return fmt.Errorf("start service %s: %w", name, err)
+	}
+	return nil
+}
+
+func (scmServiceAPI) Stop(name string, timeout time.Duration) error {
+	m, s, err := openService(name)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return fmt.Errorf("stop service %s: %w", name, err)
+	}
+	deadline := time.Now().Add(timeout)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("stop service %s: timeout", name)
+		}
+		time.Sleep(300 * time.Millisecond)
+		status, err = s.Query()
+		if err != nil {
+			return fmt.Errorf("query service %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (scmServiceAPI) Query(name string) (ServiceStatus, error) {
+	m, s, err := openService(name)
+	if err != nil {
+		return ServiceUnknown, err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	status, err := s.Query()
+	if err != nil {
+		return ServiceUnknown, fmt.Errorf("query service %s: %w", name, err)
+	}
+	switch status.State {
+	case svc.Running, svc.StartPending, svc.ContinuePending:
+		return ServiceRunning, nil
+	case svc.Stopped, svc.StopPending, svc.Paused, svc.PausePending:
+		return ServiceStopped, nil
+	}
+	return ServiceUnknown, nil
+}
+
+func (scmServiceAPI) List() ([]string, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer m.Disconnect()
+	return m.ListServices()
+}
+
+func (scmServiceAPI) BinaryPath(name string) (string, error) {
+	m, s, err := openService(name)
+	if err != nil {
+		return "", err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	config, err := s.Config()
+	if err != nil {
+		return "", fmt.Errorf("read config of service %s: %w", name, err)
+	}
+	return config.BinaryPathName, nil
+}
@@ -6,11 +6,19 @@ import (
 	"fmt"
 	"github.com/axgle/mahonia"
 	"os/exec"
+	"strings"
 )
 
 // StartAgent Start zabbix agent
-func StartAgent(scriptAbsPath string) error {
+// When root installs the agent for another user, the script is run as that user.
+func StartAgent(scriptAbsPath string, username string) error {
 	cmd := exec.Command("sh", scriptAbsPath, "restart")
+	if IsOtherUser(username) {
+		err := SetCommandUser(cmd, username)
+		if err != nil {
+			return err
+		}
+	}
 	_, err := cmd.Output()
 	if err != nil {
 		return err
@@ -18,15 +26,36 @@ func StartAgent(scriptAbsPath string) error {
 	return nil
 }
 
-// ShowAgentProcess Check zabbix agent process
-func ShowAgentProcess() error {
-	c2 := exec.Command("sh", "-c", "ps -ef|grep -E 'UID|zabbix' |grep -Ev 'installer|grep'")
-	out, err := c2.Output()
+// RunCommand runs the command and returns its trimmed combined output.
+// The output is appended to the error when the command fails.
+func RunCommand(name string, args ...string) (string, error) {
+	return runCommand(exec.Command(name, args...))
+}
+
+// RunUserCommand runs the command like RunCommand, as username when root runs it for another user.
+func RunUserCommand(username string, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	if IsOtherUser(username) {
+		err := SetCommandUser(cmd, username)
+		if err != nil {
+			return "", err
+		}
+	}
+	return runCommand(cmd)
+}
+
+// runCommand runs cmd and returns its trimmed combined output
+func runCommand(cmd *exec.Cmd) (string, error) {
+	out, err := cmd.CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	command := strings.Join(cmd.Args, " ")
 	if err != nil {
-		return err
+		if output != "" {
+			return output, fmt.Errorf("%s: %s: %s", command, err.Error(), output)
+		}
+		return output, fmt.Errorf("%s: %s", command, err.Error())
 	}
-	fmt.Print(string(out))
-	return nil
+	return output, nil
 }
 
 // RunWinCommand windows run command
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"unicode"
+	"zabbix_agent_installer/utils"
+)
+
+// ServiceStatus represents the state of the zabbix agent service.
+type ServiceStatus int
+
+const (
+	ServiceUnknown ServiceStatus = iota
+	ServiceNotInstalled
+	ServiceStopped
+	ServiceRunning
+)
+
+func (s ServiceStatus) String() string {
+	switch s {
+	case ServiceNotInstalled:
+		return "not installed"
+	case ServiceStopped:
+		return "stopped"
+	case ServiceRunning:
+		return "running"
+	}
+	return "unknown"
+}
+
+// AgentService describes the zabbix agent managed by a ServiceManager.
+type AgentService struct {
+	Name         string
+	DirPath      string
+	BinPath      string
+	ConfPath     string
+	ScriptPath   string
+	CronSchedule string
+	User         string
+	// MultipleAgents gives the service a name of its own, so that several agents can be installed.
+	MultipleAgents bool
+}
+
+// serviceNameRegexp matches the characters not allowed in a service name on linux
+var serviceNameRegexp = regexp.MustCompile(`[^0-9A-Za-z_.-]+`)
+
+// NewAgentService returns the service description of the agent in pathConfig.
+// The service is named after the agent directory, on windows it is the Zabbix Agent service.
+// With -multiple-agents the windows service gets the Hostname, like zabbix_agentd -m does,
+// and the linux service the name of AgentDir, which does not change with the Hostname.
+func NewAgentService(config *Config, pathConfig *PathConfig) *AgentService {
+	name := filepath.Base(pathConfig.ZabbixAgentDirAbsPath)
+	if config.OSType == "windows" {
+		name = WindowsServiceName
+		if config.MultipleAgents {
+			name += " [" + config.Hostname + "]"
+		}
+	} else if config.MultipleAgents {
+		name += "_" + serviceNameRegexp.ReplaceAllString(filepath.Base(config.AgentDir), "_")
+	}
+	return &AgentService{
+		MultipleAgents: config.MultipleAgents,
+		Name:           name,
+		DirPath:        pathConfig.ZabbixAgentDirAbsPath,
+		BinPath:        pathConfig.ZabbixAgentBinAbsPath,
+		ConfPath:       pathConfig.ZabbixAgentConfAbsPath,
+		ScriptPath:     pathConfig.ZabbixAgentAbsPath,
+		CronSchedule:   config.CronSchedule,
+		User:           config.AgentUser,
+	}
+}
+
+// runUser returns the user the agent is run as.
+func (s *AgentService) runUser() string {
+	if s.User == "" {
+		return "root"
+	}
+	return s.User
+}
+
+// installedName returns the name of the service file in dir, ending with suffix, which runs the agent binary,
+// and keeps it as Name. The name computed from -multiple-agents may not be the installed one when the flag
+// is not given again. Name is returned if no file runs the binary.
+func (s *AgentService) installedName(dir string, suffix string) string {
+	if serviceFileRuns(filepath.Join(dir, s.Name+suffix), s.BinPath) {
+		return s.Name
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+suffix))
+	for _, file := range files {
+		if serviceFileRuns(file, s.BinPath) {
+			s.Name = strings.TrimSuffix(filepath.Base(file), suffix)
+			break
+		}
+	}
+	return s.Name
+}
+
+// serviceFileRuns returns true if binAbsPath is one of the words of the service file
+func serviceFileRuns(fileAbsPath string, binAbsPath string) bool {
+	data, err := os.ReadFile(fileAbsPath)
+	if err != nil {
+		return false
+	}
+	words := strings.FieldsFunc(string(data), func(r rune) bool {
+		return unicode.IsSpace(r) || r == '=' || r == '"' || r == '\''
+	})
+	for _, word := range words {
+		if word == binAbsPath {
+			return true
+		}
+	}
+	return false
+}
+
+// ServiceManager registers the zabbix agent with the init system and controls it.
+type ServiceManager interface {
+	// Name returns the name of the init system.
+	Name() string
+	// Install registers the agent, it is safe to call on a registered agent.
+	Install() error
+	// Start starts the agent, restarting it if it is already running.
+	Start() error
+	// Stop stops the agent.
+	Stop() error
+	// Status returns the state of the agent.
+	Status() (ServiceStatus, error)
+	// Remove stops the agent and removes the registration.
+	Remove() error
+}
+
+// DetectServiceManager returns the service manager of the running system.
+// Init systems can only be used by root, normal users fall back to crontab.
+// Windows always uses the service control manager.
+func DetectServiceManager(service *AgentService) ServiceManager {
+	if runtime.GOOS == "windows" {
+		return NewWindowsManager(service)
+	}
+	if !IsRoot() {
+		return NewCronManager(service)
+	}
+	switch {
+	case IsSystemd():
+		return NewSystemdManager(service)
+	case IsOpenRC():
+		return NewOpenRCManager(service)
+	case IsUpstart():
+		return NewUpstartManager(service)
+	case IsSysV():
+		return NewSysVManager(service)
+	}
+	return NewCronManager(service)
+}
+
+// IsSystemd returns true if the system was booted with systemd.
+func IsSystemd() bool {
+	ok, _ := utils.PathExists("/run/systemd/system")
+	return ok && IsCommandExist("systemctl")
+}
+
+// IsOpenRC returns true if the system is managed by OpenRC.
+func IsOpenRC() bool {
+	ok, _ := utils.PathExists("/run/openrc")
+	return ok && IsCommandExist("rc-service")
+}
+
+// IsUpstart returns true if the system is managed by upstart.
+func IsUpstart() bool {
+	if !IsCommandExist("initctl") {
+		return false
+	}
+	out, err := RunCommand("initctl", "version")
+	return err == nil && strings.Contains(out, "upstart")
+}
+
+// IsSysV returns true if the system has SysV init scripts.
+func IsSysV() bool {
+	ok, _ := utils.PathExists("/etc/init.d")
+	return ok
+}
+
+// IsCommandExist returns true if the command can be found in PATH.
+func IsCommandExist(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// writeServiceFile writes the content to the file if it has changed.
+func writeServiceFile(fileAbsPath string, content string, perm os.FileMode) error {
+	old, err := os.ReadFile(fileAbsPath)
+	if err == nil && string(old) == content {
+		return nil
+	}
+	err = os.MkdirAll(filepath.Dir(fileAbsPath), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(fileAbsPath, []byte(content), perm)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(fileAbsPath, perm)
+}
+
+// removeServiceFile removes the file, a missing file is not an error.
+func removeServiceFile(fileAbsPath string) error {
+	err := os.Remove(fileAbsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// SystemdManager manages the agent with a systemd unit.
+type SystemdManager struct {
+	service *AgentService
+	UnitDir string
+}
+
+func NewSystemdManager(service *AgentService) *SystemdManager {
+	return &SystemdManager{service: service, UnitDir: "/etc/systemd/system"}
+}
+
+func (m *SystemdManager) Name() string {
+	return "systemd"
+}
+
+// name returns the name of the unit running the agent
+func (m *SystemdManager) name() string {
+	return m.service.installedName(m.UnitDir, ".service")
+}
+
+func (m *SystemdManager) unitAbsPath() string {
+	return filepath.Join(m.UnitDir, m.name()+".service")
+}
+
+func (m *SystemdManager) Install() error {
+	unit := fmt.Sprintf(`[Unit]
+Description=Zabbix Agent (%s)
+After=network.target
+
+[Service]
+Type=simple
+User=%s
+ExecStart=%s -c %s -f
+Restart=on-failure
+RestartSec=10s
+
+[Install]
+WantedBy=multi-user.target
+`, m.service.DirPath, m.service.runUser(), m.service.BinPath, m.service.ConfPath)
+	err := writeServiceFile(m.unitAbsPath(), unit, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = RunCommand("systemctl", "daemon-reload")
+	if err != nil {
+		return err
+	}
+	_, err = RunCommand("systemctl", "enable", m.name())
+	return err
+}
+
+func (m *SystemdManager) Start() error {
+	_, err := RunCommand("systemctl", "restart", m.name())
+	return err
+}
+
+func (m *SystemdManager) Stop() error {
+	_, err := RunCommand("systemctl", "stop", m.name())
+	return err
+}
+
+func (m *SystemdManager) Status() (ServiceStatus, error) {
+	if IsFileNotExist(m.unitAbsPath()) {
+		return ServiceNotInstalled, nil
+	}
+	// is-active exits non-zero for every state but active
+	out, _ := RunCommand("systemctl", "is-active", m.name())
+	switch out {
+	case "active", "activating", "reloading":
+		return ServiceRunning, nil
+	case "inactive", "failed", "deactivating":
+		return ServiceStopped, nil
+	}
+	return ServiceUnknown, fmt.Errorf("unknown systemd state: %s", out)
+}
+
+func (m *SystemdManager) Remove() error {
+	if IsFileNotExist(m.unitAbsPath()) {
+		return nil
+	}
+	_, err := RunCommand("systemctl", "disable", "--now", m.name())
+	if err != nil {
+		return err
+	}
+	err = removeServiceFile(m.unitAbsPath())
+	if err != nil {
+		return err
+	}
+	_, err = RunCommand("systemctl", "daemon-reload")
+	return err
+}
+
+// SysVManager manages the agent with a SysV init script.
+type SysVManager struct {
+	service *AgentService
+	InitDir string
+}
+
+func NewSysVManager(service *AgentService) *SysVManager {
+	return &SysVManager{service: service, InitDir: "/etc/init.d"}
+}
+
+func (m *SysVManager) Name() string {
+	return "sysvinit"
+}
+
+// name returns the name of the init script running the agent
+func (m *SysVManager) name() string {
+	return m.service.installedName(m.InitDir, "")
+}
+
+func (m *SysVManager) scriptAbsPath() string {
+	return filepath.Join(m.InitDir, m.name())
+}
+
+func (m *SysVManager) Install() error {
+	script := fmt.Sprintf(`#!/bin/sh
+#
+# chkconfig: 2345 90 10
+# description: Zabbix Agent (%[1]s)
+#
+### BEGIN INIT INFO
+# Provides:          %[2]s
+# Required-Start:    $network $remote_fs
+# Required-Stop:     $network $remote_fs
+# Default-Start:     2 3 4 5
+# Default-Stop:      0 1 6
+# Short-Description: Zabbix Agent (%[1]s)
+### END INIT INFO
+
+DAEMON="%[3]s"
+CONF="%[4]s"
+RUN_USER="%[5]s"
+PIDFILE=$(sed -n 's/^[[:space:]]*PidFile[[:space:]]*=[[:space:]]*//p' "$CONF" | tail -n 1)
+PIDFILE=${PIDFILE:-/tmp/zabbix_agentd.pid}
+
+is_running() {
+	[ -f "$PIDFILE" ] && kill -0 "$(cat "$PIDFILE")" 2>/dev/null
+}
+
+start() {
+	is_running || su -s /bin/sh -c "\"$DAEMON\" -c \"$CONF\"" "$RUN_USER"
+}
+
+# stop waits up to 10 seconds for the agent to exit
+stop() {
+	is_running || return 0
+	kill "$(cat "$PIDFILE")"
+	for i in 1 2 3 4 5 6 7 8 9 10; do
+		is_running || return 0
+		sleep 1
+	done
+	echo "zabbix agent did not stop"
+	return 1
+}
+
+case "$1" in
+start)
+	start
+	;;
+stop)
+	stop
+	;;
+restart)
+	stop && start
+	;;
+status)
+	if is_running; then
+		echo "running"
+	else
+		echo "stopped"
+		exit 3
+	fi
+	;;
+*)
+	echo "Usage: $0 {start|stop|restart|status}"
+	exit 2
+	;;
+esac
+`, m.service.DirPath, m.name(), m.service.BinPath, m.service.ConfPath, m.service.runUser())
+	err := writeServiceFile(m.scriptAbsPath(), script, 0755)
+	if err != nil {
+		return err
+	}
+	if IsCommandExist("chkconfig") {
+		_, err = RunCommand("chkconfig", "--add", m.name())
+		return err
+	}
+	if IsCommandExist("update-rc.d") {
+		_, err = RunCommand("update-rc.d", m.name(), "defaults")
+		return err
+	}
+	utils.Warn("neither chkconfig nor update-rc.d found, the agent will not start on boot", "service", m.name())
+	return nil
+}
+
+func (m *SysVManager) Start() error {
+	_, err := RunCommand(m.scriptAbsPath(), "restart")
+	return err
+}
+
+func (m *SysVManager) Stop() error {
+	_, err := RunCommand(m.scriptAbsPath(), "stop")
+	return err
+}
+
+func (m *SysVManager) Status() (ServiceStatus, error) {
+	if IsFileNotExist(m.scriptAbsPath()) {
+		return ServiceNotInstalled, nil
+	}
+	_, err := RunCommand(m.scriptAbsPath(), "status")
+	if err != nil {
+		return ServiceStopped, nil
+	}
+	return ServiceRunning, nil
+}
+
+func (m *SysVManager) Remove() error {
+	if IsFileNotExist(m.scriptAbsPath()) {
+		return nil
+	}
+	err := m.Stop()
+	if err != nil {
+		return err
+	}
+	if IsCommandExist("chkconfig") {
+		_, err = RunCommand("chkconfig", "--del", m.name())
+	} else if IsCommandExist("update-rc.d") {
+		_, err = RunCommand("update-rc.d", "-f", m.name(), "remove")
+	}
+	if err != nil {
+		return err
+	}
+	return removeServiceFile(m.scriptAbsPath())
+}
+
+// OpenRCManager manages the agent with an OpenRC service script.
+type OpenRCManager struct {
+	service *AgentService
+	InitDir string
+}
+
+func NewOpenRCManager(service *AgentService) *OpenRCManager {
+	return &OpenRCManager{service: service, InitDir: "/etc/init.d"}
+}
+
+func (m *OpenRCManager) Name() string {
+	return "openrc"
+}
+
+// name returns the name of the service script running the agent
+func (m *OpenRCManager) name() string {
+	return m.service.installedName(m.InitDir, "")
+}
+
+func (m *OpenRCManager) scriptAbsPath() string {
+	return filepath.Join(m.InitDir, m.name())
+}
+
+func (m *OpenRCManager) Install() error {
+	script := fmt.Sprintf(`#!/sbin/openrc-run
+
+description="Zabbix Agent (%s)"
+command="%s"
+command_args="-c %s -f"
+command_user="%s"
+command_background=true
+pidfile="/run/${RC_SVCNAME}.pid"
+
+depend() {
+	need net
+}
+`, m.service.DirPath, m.service.BinPath, m.service.ConfPath, m.service.runUser())
+	err := writeServiceFile(m.scriptAbsPath(), script, 0755)
+	if err != nil {
+		return err
+	}
+	_, err = RunCommand("rc-update", "add", m.name(), "default")
+	return err
+}
+
+func (m *OpenRCManager) Start() error {
+	_, err := RunCommand("rc-service", m.name(), "restart")
+	return err
+}
+
+func (m *OpenRCManager) Stop() error {
+	_, err := RunCommand("rc-service", m.name(), "stop")
+	return err
+}
+
+func (m *OpenRCManager) Status() (ServiceStatus, error) {
+	if IsFileNotExist(m.scriptAbsPath()) {
+		return ServiceNotInstalled, nil
+	}
+	_, err := RunCommand("rc-service", m.name(), "status")
+	if err != nil {
+		return ServiceStopped, nil
+	}
+	return ServiceRunning, nil
+}
+
+func (m *OpenRCManager) Remove() error {
+	if IsFileNotExist(m.scriptAbsPath()) {
+		return nil
+	}
+	err := m.Stop()
+	if err != nil {
+		return err
+	}
+	_, err = RunCommand("rc-update", "del", m.name(), "default")
+	if err != nil {
+		return err
+	}
+	return removeServiceFile(m.scriptAbsPath())
+}
+
+// UpstartManager manages the agent with an upstart job.
+type UpstartManager struct {
+	service *AgentService
+	JobDir  string
+}
+
+func NewUpstartManager(service *AgentService) *UpstartManager {
+	return &UpstartManager{service: service, JobDir: "/etc/init"}
+}
+
+func (m *UpstartManager) Name() string {
+	return "upstart"
+}
+
+// name returns the name of the job running the agent
+func (m *UpstartManager) name() string {
+	return m.service.installedName(m.JobDir, ".conf")
+}
+
+func (m *UpstartManager) jobAbsPath() string {
+	return filepath.Join(m.JobDir, m.name()+".conf")
+}
+
+func (m *UpstartManager) Install() error {
+	job := fmt.Sprintf(`description "Zabbix Agent (%s)"
+
+start on runlevel [2345]
+stop on runlevel [!2345]
+
+respawn
+exec su -s /bin/sh -c 'exec "%s" -c "%s" -f' %s
+`, m.service.DirPath, m.service.BinPath, m.service.ConfPath, m.service.runUser())
+	err := writeServiceFile(m.jobAbsPath(), job, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = RunCommand("initctl", "reload-configuration")
+	return err
+}
+
+func (m *UpstartManager) Start() error {
+	// restart fails when the job is not running
+	_, err := RunCommand("initctl", "restart", m.name())
+	if err != nil {
+		_, err = RunCommand("initctl", "start", m.name())
+	}
+	return err
+}
+
+func (m *UpstartManager) Stop() error {
+	_, err := RunCommand("initctl", "stop", m.name())
+	return err
+}
+
+func (m *UpstartManager) Status() (ServiceStatus, error) {
+	if IsFileNotExist(m.jobAbsPath()) {
+		return ServiceNotInstalled, nil
+	}
+	out, err := RunCommand("initctl", "status", m.name())
+	if err != nil {
+		return ServiceUnknown, err
+	}
+	if strings.Contains(out, "start/running") {
+		return ServiceRunning, nil
+	}
+	return ServiceStopped, nil
+}
+
+func (m *UpstartManager) Remove() error {
+	if IsFileNotExist(m.jobAbsPath()) {
+		return nil
+	}
+	// stop fails when the job is not running
+	_ = m.Stop()
+	err := removeServiceFile(m.jobAbsPath())
+	if err != nil {
+		return err
+	}
+	_, err = RunCommand("initctl", "reload-configuration")
+	return err
+}
+
+// CronManager keeps the agent alive with the startup script and a crontab entry.
+type CronManager struct {
+	service *AgentService
+}
+
+func NewCronManager(service *AgentService) *CronManager {
+	return &CronManager{service: service}
+}
+
+func (m *CronManager) Name() string {
+	return "crontab"
+}
+
+func (m *CronManager) Install() error {
+	return SetCronEntry(m.service.User, m.service.ScriptPath, CronEntry(m.service.CronSchedule, m.service.ScriptPath))
+}
+
+func (m *CronManager) Start() error {
+	return StartAgent(m.service.ScriptPath, m.service.User)
+}
+
+func (m *CronManager) Stop() error {
+	for _, p := range GetAgentProcesses(m.service.BinPath) {
+		err := p.Terminate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *CronManager) Status() (ServiceStatus, error) {
+	if len(GetAgentProcesses(m.service.BinPath)) != 0 {
+		return ServiceRunning, nil
+	}
+	_, ok, err := FindCronEntry(m.service.User, m.service.ScriptPath)
+	if err != nil {
+		return ServiceUnknown, err
+	}
+	if ok {
+		return ServiceStopped, nil
+	}
+	return ServiceNotInstalled, nil
+}
+
+func (m *CronManager) Remove() error {
+	err := m.Stop()
+	if err != nil {
+		return err
+	}
+	return RemoveCronEntry(m.service.User, m.service.ScriptPath)
+}
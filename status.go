@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"zabbix_agent_installer/utils"
+)
+
+// statusLogLines is the number of agent log lines shown by status
+const statusLogLines = 10
+
+// statusConfKeys are the agent parameters shown by status
+var statusConfKeys = []string{"Server", "ServerActive", "Hostname", "ListenPort"}
+
+// AgentStatus is the health of an installed agent.
+type AgentStatus struct {
+	Version   string            `json:"version"`
+	Conf      map[string]string `json:"conf"`
+	Processes []ProcessStatus   `json:"processes"`
+	LogFile   string            `json:"log_file,omitempty"`
+	LogTail   []string          `json:"log_tail,omitempty"`
+	Server    string            `json:"server,omitempty"`
+	Reachable bool              `json:"server_reachable"`
+}
+
+// ProcessStatus is a running agent process.
+type ProcessStatus struct {
+	Pid      int32  `json:"pid"`
+	Uptime   string `json:"uptime"`
+	RSSBytes uint64 `json:"rss_bytes"`
+}
+
+// status reports the agent installed in AgentDir, or each selected instance
+func status(config *Config, result *Result) error {
+	configs, err := installedConfigs(config)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for i, instanceConfig := range configs {
+		if i > 0 {
+			fmt.Fprintln(textOutput(config))
+		}
+		err = statusInstance(instanceConfig, result)
+		if err != nil {
+			if len(configs) > 1 {
+				utils.Error(err.Error(), "instance", instanceConfig.Instance)
+			}
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// statusInstance reports the agent of config
+func statusInstance(config *Config, result *Result) error {
+	var pathConfig = &PathConfig{}
+	err := locateAgent(config, pathConfig)
+	if err != nil {
+		return err
+	}
+	agentStatus, err := ReadAgentStatus(config, pathConfig)
+	if err != nil {
+		return NewError(FilesystemError, err)
+	}
+	var pids []int32
+	for _, p := range agentStatus.Processes {
+		pids = append(pids, p.Pid)
+	}
+	service := agentServiceInfo(config, pathConfig)
+	result.AddAgent(config, pathConfig, pids, service, agentStatus)
+	PrintAgentStatus(textOutput(config), pathConfig, service, agentStatus)
+	if len(agentStatus.Processes) == 0 {
+		return Errorf(ServiceError, "zabbix agent is not running")
+	}
+	if agentStatus.Server != "" && !agentStatus.Reachable {
+		utils.Warn("zabbix server is unreachable", "server", agentStatus.Server, "instance", config.Instance)
+	}
+	return nil
+}
+
+// installedConfigs resolves AgentDir and returns the configs of the selected instances
+func installedConfigs(config *Config) ([]*Config, error) {
+	err := resolveInstalledConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	configs, err := InstanceConfigs(config)
+	if err != nil {
+		return nil, NewError(ServiceError, err)
+	}
+	return configs, nil
+}
+
+// resolveInstalledConfig reads the OS info and resolves the agent user, AgentDir and the instances
+func resolveInstalledConfig(config *Config) error {
+	err := ReadOSInfo(config)
+	if err != nil {
+		return NewError(ValidationError, err)
+	}
+	err = agentUserHandler(config)
+	if err != nil {
+		return NewError(ValidationError, err)
+	}
+	config.AgentDir, err = ResolveAgentDir(config)
+	if err != nil {
+		return NewError(ValidationError, err)
+	}
+	return NewError(ValidationError, instancesHandler(config))
+}
+
+// locateAgent computes the paths of the agent installed in AgentDir
+func locateAgent(config *Config, pathConfig *PathConfig) error {
+	SetAgentPaths(config, pathConfig)
+	if IsFileNotExist(pathConfig.ZabbixAgentBinAbsPath) {
+		return Errorf(ServiceError, "zabbix agent is not installed in %s", pathConfig.ZabbixAgentDirAbsPath)
+	}
+	return nil
+}
+
+// ReadAgentStatus reads the version, configuration, processes and log of the agent.
+func ReadAgentStatus(config *Config, pathConfig *PathConfig) (*AgentStatus, error) {
+	agentStatus := &AgentStatus{Conf: map[string]string{}, Processes: []ProcessStatus{}}
+	version, err := GetAgentVersion(pathConfig.ZabbixAgentBinAbsPath)
+	if err != nil {
+		utils.Warn("read agent version failed", "error", err)
+	}
+	agentStatus.Version = version
+	conf, err := ReadAgentConf(pathConfig.ZabbixAgentConfAbsPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range statusConfKeys {
+		if value, ok := conf.Get(key); ok {
+			agentStatus.Conf[key] = value
+		}
+	}
+	now := time.Now()
+	for _, p := range GetAgentProcesses(pathConfig.ZabbixAgentBinAbsPath) {
+		processStatus := ProcessStatus{Pid: p.Pid}
+		if createTime, err := p.CreateTime(); err == nil {
+			processStatus.Uptime = now.Sub(time.UnixMilli(createTime)).Round(time.Second).String()
+		}
+		if memoryInfo, err := p.MemoryInfo(); err == nil {
+			processStatus.RSSBytes = memoryInfo.RSS
+		}
+		agentStatus.Processes = append(agentStatus.Processes, processStatus)
+	}
+	if logFile, ok := conf.Get("LogFile"); ok {
+		agentStatus.LogFile = logFile
+		agentStatus.LogTail, err = TailFile(logFile, statusLogLines)
+		if err != nil {
+			utils.Warn("read agent log failed", "log_file", logFile, "error", err)
+		}
+	}
+	host, port := agentServer(config, conf)
+	if host != "" {
+		agentStatus.Server = net.JoinHostPort(host, port)
+		agentStatus.Reachable = !IsUnreachable(host, port)
+	}
+	return agentStatus, nil
+}
+
+// agentServer returns the server given with -s, or the first one in ServerActive
+func agentServer(config *Config, conf *AgentConf) (string, string) {
+	if config.ServerIP != "" {
+		return TrimBrackets(config.ServerIP), config.ServerPort
+	}
+	serverActive, ok := conf.Get("ServerActive")
+	if !ok || serverActive == "" {
+		return "", ""
+	}
+	server := strings.TrimSpace(strings.Split(serverActive, ",")[0])
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return TrimBrackets(server), "10051"
+	}
+	return host, port
+}
+
+// GetAgentVersion returns the version printed by zabbix_agentd -V
+func GetAgentVersion(binAbsPath string) (string, error) {
+	out, err := RunCommand(binAbsPath, "-V")
+	if err != nil {
+		return "", err
+	}
+	// zabbix_agentd (daemon) (Zabbix) 6.0.13
+	fields := strings.Fields(strings.SplitN(out, "\n", 2)[0])
+	if len(fields) == 0 {
+		return "", fmt.Errorf("no version printed by %s", binAbsPath)
+	}
+	return fields[len(fields)-1], nil
+}
+
+// TailFile returns the last n lines of the file, only the end of the file is read.
+func TailFile(fileAbsPath string, n int) ([]string, error) {
+	f, err := os.Open(fileAbsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	const chunk = 64 << 10
+	offset := fileInfo.Size() - chunk
+	if offset < 0 {
+		offset = 0
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(bytes.TrimRight(data, "\n")), "\n")
+	if offset > 0 && len(lines) > 1 {
+		// The first line is cut
+		lines = lines[1:]
+	}
+	if len(lines) == 1 && lines[0] == "" {
+		return []string{}, nil
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+// PrintAgentStatus prints the status as a report.
+func PrintAgentStatus(w io.Writer, pathConfig *PathConfig, service *ServiceInfo, agentStatus *AgentStatus) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "dir\t%s\n", pathConfig.ZabbixAgentDirAbsPath)
+	fmt.Fprintf(tw, "version\t%s\n", agentStatus.Version)
+	for _, key := range statusConfKeys {
+		fmt.Fprintf(tw, "%s\t%s\n", key, agentStatus.Conf[key])
+	}
+	if service.CronEntry != "" {
+		fmt.Fprintf(tw, "service\t%s %s, %s\n", service.Manager, service.Status, service.CronEntry)
+	} else {
+		fmt.Fprintf(tw, "service\t%s %s %s\n", service.Manager, service.Name, service.Status)
+	}
+	if len(agentStatus.Processes) == 0 {
+		fmt.Fprintf(tw, "process\tnot running\n")
+	}
+	for _, p := range agentStatus.Processes {
+		fmt.Fprintf(tw, "process\tpid %d, up %s, rss %d MiB\n", p.Pid, p.Uptime, p.RSSBytes>>20)
+	}
+	if agentStatus.Server != "" {
+		reachable := "reachable"
+		if !agentStatus.Reachable {
+			reachable = "unreachable"
+		}
+		fmt.Fprintf(tw, "server\t%s %s\n", agentStatus.Server, reachable)
+	}
+	tw.Flush()
+	if len(agentStatus.LogTail) != 0 {
+		fmt.Fprintf(w, "\n%s:\n", agentStatus.LogFile)
+		for _, line := range agentStatus.LogTail {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
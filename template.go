@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// DefaultConfTemplate renders zabbix_agentd.conf when no -template is given.
+const DefaultConfTemplate = `# zabbix_agentd.conf generated by zabbix_agent_installer
+{{- if ne .Config.OSType "windows"}}
+PidFile={{.Dir}}/zabbix_agentd.pid
+{{- end}}
+LogFile={{join .Dir "zabbix_agentd.log"}}
+LogFileSize=10
+Server={{.Config.ServerIP}}
+ServerActive={{.ServerActive}}
+Hostname={{.Config.Hostname}}
+ListenPort={{.Config.ListenPort}}
+{{- with .Config.HostMetadata}}
+HostMetadata={{.}}
+{{- end}}
+{{- with .Config.HostMetadataItem}}
+HostMetadataItem={{.}}
+{{- end}}
+{{- if eq .Config.TLS "psk"}}
+TLSConnect=psk
+TLSAccept=psk
+TLSPSKIdentity={{.Config.TLSPSKIdentity}}
+TLSPSKFile={{.Paths.ZabbixAgentPSKAbsPath}}
+{{- else if eq .Config.TLS "cert"}}
+TLSConnect=cert
+TLSAccept=cert
+TLSCAFile={{.Paths.ZabbixAgentTLSCAAbsPath}}
+TLSCertFile={{.Paths.ZabbixAgentTLSCertAbsPath}}
+TLSKeyFile={{.Paths.ZabbixAgentTLSKeyAbsPath}}
+{{- end}}
+`
+
+// DefaultScriptTemplate renders zabbix_script.sh when the package has none.
+// The script controls the agent with its PidFile, daemon starts the agent if it is not running.
+const DefaultScriptTemplate = `#!/bin/sh
+# Control script of the zabbix agent in {{.Dir}}, generated by zabbix_agent_installer
+BIN="{{.Paths.ZabbixAgentBinAbsPath}}"
+CONF="{{.Paths.ZabbixAgentConfAbsPath}}"
+PIDFILE=$(sed -n 's/^[[:space:]]*PidFile[[:space:]]*=[[:space:]]*//p' "$CONF" | tail -n 1)
+PIDFILE=${PIDFILE:-/tmp/zabbix_agentd.pid}
+
+running() {
+	[ -f "$PIDFILE" ] && kill -0 "$(cat "$PIDFILE")" 2>/dev/null
+}
+
+start() {
+	running || "$BIN" -c "$CONF"
+}
+
+stop() {
+	running || return 0
+	kill "$(cat "$PIDFILE")"
+	for i in 1 2 3 4 5 6 7 8 9 10; do
+		running || return 0
+		sleep 1
+	done
+	return 1
+}
+
+case "$1" in
+start|daemon) start ;;
+stop) stop ;;
+restart) stop && start ;;
+status)
+	if running; then
+		echo running
+	else
+		echo stopped
+		exit 1
+	fi
+	;;
+*)
+	echo "Usage: $0 {start|stop|restart|status|daemon}"
+	exit 2
+	;;
+esac
+`
+
+// TemplateData is what the templates can use.
+type TemplateData struct {
+	Config       *Config
+	Paths        *PathConfig
+	Facts        *HostFacts
+	Var          map[string]string
+	Dir          string
+	ServerActive string
+}
+
+// templateFuncs are the functions available in the templates
+var templateFuncs = template.FuncMap{
+	"join":  filepath.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"tags":  formatTags,
+	"default": func(def string, value string) string {
+		if value == "" {
+			return def
+		}
+		return value
+	},
+}
+
+// NewTemplateData returns the data of the agent of config.
+func NewTemplateData(config *Config, pathConfig *PathConfig) (*TemplateData, error) {
+	vars, err := ParseTemplateVars(config.TemplateVars)
+	if err != nil {
+		return nil, err
+	}
+	return &TemplateData{
+		Config:       config,
+		Paths:        pathConfig,
+		Facts:        ReadHostFacts(config),
+		Var:          vars,
+		Dir:          pathConfig.ZabbixAgentDirAbsPath,
+		ServerActive: FormatServerActive(config.ServerIP, config.ServerPort),
+	}, nil
+}
+
+// ParseTemplateVars parses the -var key=value options.
+func ParseTemplateVars(vars []string) (map[string]string, error) {
+	m := make(map[string]string, len(vars))
+	for _, v := range vars {
+		key, value, ok := strings.Cut(v, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid -var %s, use key=value", v)
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+// ParseTemplate parses the template text, missing keys of Var are empty.
+func ParseTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// RenderTemplate renders the template text with data.
+func RenderTemplate(name string, text string, data interface{}) ([]byte, error) {
+	tmpl, err := ParseTemplate(name, text)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// confTemplate returns the name and the text of the configuration template
+func confTemplate(config *Config) (string, string, error) {
+	if config.Template == "" {
+		return "default", DefaultConfTemplate, nil
+	}
+	text, err := os.ReadFile(config.Template)
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Base(config.Template), string(text), nil
+}
+
+// templateHandler processes the Template and the TemplateVars
+func templateHandler(config *Config) error {
+	_, err := ParseTemplateVars(config.TemplateVars)
+	if err != nil {
+		return err
+	}
+	if config.Template == "" {
+		return nil
+	}
+	config.Template, err = ExpandPath(config.Template)
+	if err != nil {
+		return err
+	}
+	config.Template, err = filepath.Abs(config.Template)
+	if err != nil {
+		return err
+	}
+	name, text, err := confTemplate(config)
+	if err != nil {
+		return err
+	}
+	_, err = ParseTemplate(name, text)
+	return err
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"zabbix_agent_installer/utils"
+)
+
+// TLS modes of the agent, the default is unencrypted
+const (
+	TLSPSK  = "psk"
+	TLSCert = "cert"
+)
+
+// pskBytes is the size of a generated PSK, zabbix accepts 16 to 256 bytes
+const pskBytes = 32
+
+// TLSInfo is the encryption of the installed agent, to be registered on the server.
+type TLSInfo struct {
+	Mode        string `json:"mode"`
+	PSKIdentity string `json:"psk_identity,omitempty"`
+	PSK         string `json:"psk,omitempty"`
+	PSKFile     string `json:"psk_file,omitempty"`
+	CAFile      string `json:"ca_file,omitempty"`
+	CertFile    string `json:"cert_file,omitempty"`
+	KeyFile     string `json:"key_file,omitempty"`
+}
+
+// GeneratePSK returns a random PSK of n bytes in hex.
+func GeneratePSK(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ValidatePSK checks the PSK is 32 to 512 hex digits.
+func ValidatePSK(psk string) error {
+	b, err := hex.DecodeString(psk)
+	if err != nil || len(b) < 16 || len(b) > 256 {
+		return fmt.Errorf("invalid PSK, use 32 to 512 hex digits")
+	}
+	return nil
+}
+
+// tlsHandler processes the TLS options, a PSK is generated unless -tls-psk is given.
+// The PSK identity defaults to the Hostname.
+func tlsHandler(config *Config) error {
+	var err error
+	switch config.TLS {
+	case "":
+		return nil
+	case TLSPSK:
+		if config.TLSPSK == "" {
+			config.TLSPSK, err = GeneratePSK(pskBytes)
+			if err != nil {
+				return err
+			}
+			config.pskGenerated = true
+		} else {
+			config.TLSPSK = strings.ToLower(strings.TrimSpace(config.TLSPSK))
+			err = ValidatePSK(config.TLSPSK)
+			if err != nil {
+				return err
+			}
+		}
+		if config.TLSPSKIdentity == "" {
+			config.TLSPSKIdentity = config.Hostname
+			config.pskIdentityDefault = true
+		}
+		if len(config.TLSPSKIdentity) > 128 || strings.ContainsAny(config.TLSPSKIdentity, "\r\n") {
+			return fmt.Errorf("invalid PSK identity: %s", config.TLSPSKIdentity)
+		}
+		return nil
+	case TLSCert:
+		for _, file := range []*string{&config.TLSCAFile, &config.TLSCertFile, &config.TLSKeyFile} {
+			if *file == "" {
+				return fmt.Errorf("-tls cert needs -tls-ca, -tls-cert and -tls-key")
+			}
+			*file, err = ExpandPath(*file)
+			if err != nil {
+				return err
+			}
+			*file, err = filepath.Abs(*file)
+			if err != nil {
+				return err
+			}
+			if IsFileNotExist(*file) {
+				return fmt.Errorf("TLS file does not exist: %s", *file)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid -tls %s, use psk or cert", config.TLS)
+}
+
+// reusePSK keeps the PSK and the identity of the installed agent when -tls-psk is not given,
+// a new key would break the encrypted connections of the server. local is the configuration
+// of the installed agent, nil on the first install.
+func reusePSK(config *Config, pathConfig *PathConfig, local *AgentConf) error {
+	if config.TLS != TLSPSK || !config.pskGenerated {
+		return nil
+	}
+	data, err := os.ReadFile(pathConfig.ZabbixAgentPSKAbsPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	psk := strings.ToLower(strings.TrimSpace(string(data)))
+	if ValidatePSK(psk) != nil {
+		utils.Warn("invalid PSK file is replaced", "file", pathConfig.ZabbixAgentPSKAbsPath)
+		return nil
+	}
+	config.TLSPSK = psk
+	if local != nil && config.pskIdentityDefault {
+		if identity, ok := local.Get("TLSPSKIdentity"); ok && identity != "" {
+			config.TLSPSKIdentity = identity
+		}
+	}
+	utils.Info("keep the PSK of the installed agent", "file", pathConfig.ZabbixAgentPSKAbsPath, "identity", config.TLSPSKIdentity)
+	return nil
+}
+
+// writePSK writes the PSK file readable by its owner only
+func writePSK(config *Config, pathConfig *PathConfig) error {
+	err := os.MkdirAll(filepath.Dir(pathConfig.ZabbixAgentPSKAbsPath), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(pathConfig.ZabbixAgentPSKAbsPath, []byte(config.TLSPSK+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of an existing file
+	return os.Chmod(pathConfig.ZabbixAgentPSKAbsPath, 0600)
+}
+
+// copyTLSFiles copies the certificate files next to zabbix_agentd.conf, readable by their owner only,
+// so that the agent user can read them once it owns the agent directory and backups include them
+func copyTLSFiles(config *Config, pathConfig *PathConfig) error {
+	files := map[string]string{
+		config.TLSCAFile:   pathConfig.ZabbixAgentTLSCAAbsPath,
+		config.TLSCertFile: pathConfig.ZabbixAgentTLSCertAbsPath,
+		config.TLSKeyFile:  pathConfig.ZabbixAgentTLSKeyAbsPath,
+	}
+	err := os.MkdirAll(filepath.Dir(pathConfig.ZabbixAgentConfAbsPath), 0755)
+	if err != nil {
+		return err
+	}
+	for src, dst := range files {
+		if IsSamePath(src, dst) {
+			continue
+		}
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		err = writeFileMode(dst, data, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewTLSInfo returns the encryption of the agent of config, nil when unencrypted.
+func NewTLSInfo(config *Config, pathConfig *PathConfig) *TLSInfo {
+	switch config.TLS {
+	case TLSPSK:
+		return &TLSInfo{Mode: TLSPSK, PSKIdentity: config.TLSPSKIdentity, PSK: config.TLSPSK, PSKFile: pathConfig.ZabbixAgentPSKAbsPath}
+	case TLSCert:
+		return &TLSInfo{Mode: TLSCert, CAFile: pathConfig.ZabbixAgentTLSCAAbsPath, CertFile: pathConfig.ZabbixAgentTLSCertAbsPath, KeyFile: pathConfig.ZabbixAgentTLSKeyAbsPath}
+	}
+	return nil
+}
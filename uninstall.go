@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"zabbix_agent_installer/utils"
+)
+
+// uninstall removes the agent installed in AgentDir, or each selected instance.
+// The agent user is kept.
+func uninstall(config *Config, result *Result) error {
+	configs, err := installedConfigs(config)
+	if err != nil {
+		return err
+	}
+	for _, instanceConfig := range configs {
+		var pathConfig = &PathConfig{}
+		err = locateAgent(instanceConfig, pathConfig)
+		if err == nil {
+			err = uninstallInstance(instanceConfig, pathConfig, result)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uninstallInstance unregisters and stops the agent of config and removes its directory
+func uninstallInstance(config *Config, pathConfig *PathConfig, result *Result) error {
+	service := NewAgentService(config, pathConfig)
+	manager := DetectServiceManager(service)
+	err := result.Step(stepName(config, "remove service"), func() error {
+		return NewError(ServiceError, manager.Remove())
+	})
+	if err != nil {
+		return err
+	}
+	utils.Info("remove service successfully", "manager", manager.Name(), "service", service.Name)
+	err = result.Step(stepName(config, "stop agent"), func() error {
+		return NewError(ServiceError, killAgentProcesses(pathConfig.ZabbixAgentBinAbsPath))
+	})
+	if err != nil {
+		return err
+	}
+	err = result.Step(stepName(config, "remove files"), func() error {
+		return NewError(FilesystemError, os.RemoveAll(pathConfig.ZabbixAgentDirAbsPath))
+	})
+	result.AddAgent(config, pathConfig, []int32{}, NewServiceInfo(manager, service), nil)
+	if err != nil {
+		return err
+	}
+	utils.Info("uninstall zabbix agent successfully", "dir", pathConfig.ZabbixAgentDirAbsPath)
+	return nil
+}
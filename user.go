@@ -1,6 +1,15 @@
 package main
 
-import "os/user"
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// DefaultAgentUser is the system user created for the agent when installed by root.
+const DefaultAgentUser = "zabbix"
 
 // Get the current user's name
 func GetCurrentUser() (string, error) {
@@ -19,3 +28,71 @@ func GetUserHomePath() (string, error) {
 	}
 	return currentUser.HomeDir, nil
 }
+
+// getuid returns the uid of the installer, replaced in the tests
+var getuid = os.Getuid
+
+// IsRoot returns true if the installer is run by root.
+func IsRoot() bool {
+	return getuid() == 0
+}
+
+// IsOtherUser returns true if root installs the agent for another user.
+func IsOtherUser(username string) bool {
+	return IsRoot() && username != "" && username != "root"
+}
+
+// LookupUserIDs returns the uid and gid of the user.
+func LookupUserIDs(username string) (int, int, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid uid of %s: %s", username, u.Uid)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid gid of %s: %s", username, u.Gid)
+	}
+	return uid, gid, nil
+}
+
+// CreateSystemUser creates a system user without login shell, an existing user is reused.
+func CreateSystemUser(username string, homeAbsPath string) error {
+	_, err := user.Lookup(username)
+	if err == nil {
+		return nil
+	}
+	if IsCommandExist("useradd") {
+		_, err = RunCommand("useradd", "-r", "-U", "-M", "-d", homeAbsPath, "-s", "/sbin/nologin", "-c", "Zabbix Agent", username)
+		return err
+	}
+	// busybox
+	if IsCommandExist("adduser") {
+		if _, err = user.LookupGroup(username); err != nil {
+			_, err = RunCommand("addgroup", "-S", username)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = RunCommand("adduser", "-S", "-D", "-H", "-h", homeAbsPath, "-s", "/sbin/nologin", "-G", username, "-g", "Zabbix Agent", username)
+		return err
+	}
+	return fmt.Errorf("neither useradd nor adduser found, create user %s then install", username)
+}
+
+// ChownR changes the owner of the path and everything under it to the user.
+func ChownR(absPath string, username string) error {
+	uid, gid, err := LookupUserIDs(username)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(absPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"zabbix_agent_installer/utils"
+)
+
+// userParamsDirName is the Include directory of the UserParameter files, next to zabbix_agentd.conf
+const userParamsDirName = "zabbix_agentd.d"
+
+// includeDirPlaceholder is replaced with the Include directory in the *.conf files,
+// so that the UserParameter commands can call the scripts deployed with them
+const includeDirPlaceholder = "%include_dir%"
+
+// userParamsHandler processes the UserParams, a directory or a .tar.gz or .zip archive
+func userParamsHandler(config *Config) error {
+	if config.UserParams == "" {
+		return nil
+	}
+	var err error
+	config.UserParams, err = ExpandPath(config.UserParams)
+	if err != nil {
+		return err
+	}
+	config.UserParams, err = filepath.Abs(config.UserParams)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(config.UserParams)
+	if err != nil {
+		return fmt.Errorf("user parameters not found: %s", config.UserParams)
+	}
+	name := filepath.Base(config.UserParams)
+	if !info.IsDir() && !strings.HasSuffix(name, ".zip") && !strings.HasSuffix(name, ".tar.gz") {
+		return fmt.Errorf("user parameters must be a directory, a .tar.gz or a .zip: %s", config.UserParams)
+	}
+	return nil
+}
+
+// deployUserParams copies the UserParameter files and scripts into the Include directory
+// and adds the Include line to zabbix_agentd.conf.
+// The *.conf files are readable, the other files are scripts and made executable.
+func deployUserParams(config *Config, pathConfig *PathConfig) error {
+	srcDir := config.UserParams
+	if info, err := os.Stat(srcDir); err == nil && !info.IsDir() {
+		var stagingDir string
+		stagingDir, srcDir, err = unpackStaging(config.UserParams, config.AgentDir)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(stagingDir)
+	}
+	includeDir := pathConfig.ZabbixAgentIncludeAbsPath
+	err := filepath.WalkDir(srcDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(includeDir, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(path, ".conf") {
+			data = []byte(strings.ReplaceAll(string(data), includeDirPlaceholder, includeDir))
+			return writeFileMode(target, data, 0644)
+		}
+		return writeFileMode(target, data, 0755)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = UserParamKeys(includeDir)
+	if err != nil {
+		return NewError(ValidationError, err)
+	}
+	conf, err := ReadAgentConf(pathConfig.ZabbixAgentConfAbsPath)
+	if err != nil {
+		return err
+	}
+	include := filepath.Join(includeDir, "*.conf")
+	for _, value := range conf.GetAll("Include") {
+		if value == include {
+			return nil
+		}
+	}
+	conf.Add("Include", include)
+	return conf.WriteFile(pathConfig.ZabbixAgentConfAbsPath)
+}
+
+// writeFileMode writes the file and sets its mode, WriteFile keeps the mode of an existing file
+func writeFileMode(fileAbsPath string, data []byte, mode os.FileMode) error {
+	err := os.WriteFile(fileAbsPath, data, mode)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(fileAbsPath, mode)
+}
+
+// UserParamKeys returns the keys of the UserParameter lines of the *.conf files in dir.
+// A flexible key like disk.io[*] keeps its [*].
+func UserParamKeys(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var keys []string
+	for _, file := range files {
+		conf, err := ReadAgentConf(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range conf.GetAll("UserParameter") {
+			key, command, ok := strings.Cut(value, ",")
+			key = strings.TrimSpace(key)
+			if !ok || strings.TrimSuffix(key, "[*]") == "" || strings.TrimSpace(command) == "" || strings.ContainsAny(key, " \t") {
+				return nil, fmt.Errorf("invalid UserParameter in %s: %s", file, value)
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// testUserParams runs zabbix_agentd -t with each deployed key as the agent user, every key must be supported.
+// A flexible key is tested without parameters, which its command may not support, so it only warns.
+func testUserParams(config *Config, pathConfig *PathConfig) error {
+	keys, err := UserParamKeys(pathConfig.ZabbixAgentIncludeAbsPath)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, key := range keys {
+		flexible := strings.HasSuffix(key, "[*]")
+		key = strings.TrimSuffix(key, "[*]")
+		output, err := RunUserCommand(config.AgentUser, pathConfig.ZabbixAgentBinAbsPath, "-c", pathConfig.ZabbixAgentConfAbsPath, "-t", key)
+		if err != nil || strings.Contains(output, "ZBX_NOTSUPPORTED") {
+			if flexible {
+				utils.Warn("flexible user parameter failed without parameters", "key", key, "output", output)
+				continue
+			}
+			failed = append(failed, key)
+			utils.Warn("user parameter failed", "key", key, "output", output)
+			continue
+		}
+		utils.Info("test user parameter", "key", key, "output", output)
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("user parameters not supported: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
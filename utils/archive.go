@@ -0,0 +1,206 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ArchiveWriter writes a tar.gz or zip archive.
+type ArchiveWriter interface {
+	// AddBytes adds a file named name holding data.
+	AddBytes(name string, data []byte, mode os.FileMode) error
+	// AddTree adds the directories, regular files and symlinks of srcDir under prefix,
+	// with their permissions and modification times. skip is called with the path
+	// relative to srcDir, skipped directories are not walked.
+	AddTree(srcDir string, prefix string, skip func(rel string) bool) error
+	// Close finishes the archive.
+	Close() error
+}
+
+// CreateArchive creates the archive dst, a .zip or a .tar.gz.
+func CreateArchive(dst string) (ArchiveWriter, error) {
+	switch {
+	case strings.HasSuffix(dst, ".zip"):
+		return CreateZip(dst)
+	case strings.HasSuffix(dst, ".tar.gz"):
+		return CreateTarGz(dst)
+	}
+	return nil, fmt.Errorf("unknown file format: %s", dst)
+}
+
+// archiveEntry is a file of a directory tree being archived
+type archiveEntry struct {
+	// Name is the slash separated name in the archive, directories end with /
+	Name string
+	Path string
+	Info os.FileInfo
+	// Link is the target of a symlink
+	Link string
+}
+
+// walkTree calls add with the directories, regular files and symlinks of srcDir, parents first.
+// Symlinks are not followed, other files like sockets are skipped.
+func walkTree(srcDir string, prefix string, skip func(rel string) bool, add func(entry archiveEntry) error) error {
+	return filepath.WalkDir(srcDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && skip != nil && skip(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := archiveEntry{Name: filepath.ToSlash(filepath.Join(prefix, rel)), Path: path, Info: info}
+		switch {
+		case info.IsDir():
+			if entry.Name == "." {
+				// the top of the tree without prefix
+				return nil
+			}
+			entry.Name += "/"
+		case info.Mode()&os.ModeSymlink != 0:
+			entry.Link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		case !info.Mode().IsRegular():
+			Debug("skip file", "file", path)
+			return nil
+		}
+		return add(entry)
+	})
+}
+
+// copyFile copies the content of the file at path to w
+func copyFile(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// extractPath returns the path of the archived file name in dst. Names leaving dst, directly
+// or through a symlink already extracted, are refused.
+func extractPath(dst string, name string) (string, error) {
+	dst = filepath.Clean(dst)
+	path := filepath.Join(dst, name)
+	if path != dst && !strings.HasPrefix(path, dst+string(os.PathSeparator)) {
+		return "", fmt.Errorf("illegal file path: %s", name)
+	}
+	err := checkParents(dst, path)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// checkParents refuses path if one of its parent directories below dst is a symlink
+func checkParents(dst string, path string) error {
+	rel, err := filepath.Rel(dst, filepath.Dir(path))
+	if err != nil || rel == "." {
+		return err
+	}
+	parent := dst
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		parent = filepath.Join(parent, part)
+		info, err := os.Lstat(parent)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("illegal file path through symlink %s: %s", parent, path)
+		}
+	}
+	return nil
+}
+
+// extractFile writes the content of r to path with mode and modification time
+func extractFile(path string, r io.Reader, mode os.FileMode, modTime time.Time) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	// a symlink extracted before is replaced, not written through
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		os.Remove(path)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// OpenFile keeps the mode of an existing file and applies the umask
+	err = os.Chmod(path, mode.Perm())
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, modTime, modTime)
+}
+
+// extractSymlink creates the symlink path to target, the target must stay in dst.
+// The target may only go up before naming a file, so that a symlink it goes through
+// can not lead out of dst.
+func extractSymlink(dst string, path string, target string) error {
+	illegal := fmt.Errorf("illegal symlink %s to %s", path, target)
+	if filepath.IsAbs(target) || strings.HasPrefix(filepath.ToSlash(target), "/") {
+		return illegal
+	}
+	named := false
+	for _, part := range strings.Split(filepath.ToSlash(target), "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if named {
+				return illegal
+			}
+		default:
+			named = true
+		}
+	}
+	rel, err := filepath.Rel(dst, filepath.Join(filepath.Dir(path), target))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return illegal
+	}
+	err = checkParents(filepath.Clean(dst), path)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	os.Remove(path)
+	return os.Symlink(target, path)
+}
+
+// dirTimes sets the modification times of the extracted directories once their files are written
+type dirTimes map[string]time.Time
+
+func (d dirTimes) apply() error {
+	for path, modTime := range d {
+		err := os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTree writes a tree of files with modes, a symlink and fixed modification times
+func writeTree(t *testing.T, dir string, modTime time.Time) {
+	t.Helper()
+	for name, mode := range map[string]os.FileMode{"sbin/zabbix_agentd": 0755, "etc/zabbix_agentd.conf": 0640, "readme": 0644} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name+"\nno trailing newline"), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sbin/zabbix_agentd", filepath.Join(dir, "agent")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"sbin/zabbix_agentd", "etc/zabbix_agentd.conf", "readme", "sbin", "etc", "empty"} {
+		if err := os.Chtimes(filepath.Join(dir, name), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	modTime := time.Date(2024, 3, 1, 12, 30, 45, 0, time.UTC)
+	srcDir := t.TempDir()
+	writeTree(t, srcDir, modTime)
+	for _, ext := range []string{".tar.gz", ".zip"} {
+		archive := filepath.Join(t.TempDir(), "agent"+ext)
+		w, err := CreateArchive(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = w.AddTree(srcDir, "zabbix_agentd", func(rel string) bool { return rel == "readme" }); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.AddBytes("info.json", []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		dstDir := t.TempDir()
+		if err = UnpackingFile(archive, dstDir); err != nil {
+			t.Fatalf("%s: %v", ext, err)
+		}
+		for name, mode := range map[string]os.FileMode{"zabbix_agentd/sbin/zabbix_agentd": 0755, "zabbix_agentd/etc/zabbix_agentd.conf": 0640, "info.json": 0600} {
+			path := filepath.Join(dstDir, name)
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Errorf("%s: %v", ext, err)
+				continue
+			}
+			if info.Mode().Perm() != mode {
+				t.Errorf("%s: %s mode %v", ext, name, info.Mode())
+			}
+			if name != "info.json" && !info.ModTime().Equal(modTime) {
+				t.Errorf("%s: %s modified %v", ext, name, info.ModTime())
+			}
+		}
+		data, _ := os.ReadFile(filepath.Join(dstDir, "zabbix_agentd/etc/zabbix_agentd.conf"))
+		if string(data) != "etc/zabbix_agentd.conf\nno trailing newline" {
+			t.Errorf("%s: content %q", ext, data)
+		}
+		if link, err := os.Readlink(filepath.Join(dstDir, "zabbix_agentd/agent")); err != nil || link != "sbin/zabbix_agentd" {
+			t.Errorf("%s: symlink %s, %v", ext, link, err)
+		}
+		if info, err := os.Stat(filepath.Join(dstDir, "zabbix_agentd/empty")); err != nil || !info.IsDir() || !info.ModTime().Equal(modTime) {
+			t.Errorf("%s: empty dir %v, %v", ext, info, err)
+		}
+		if _, err := os.Stat(filepath.Join(dstDir, "zabbix_agentd/readme")); !os.IsNotExist(err) {
+			t.Errorf("%s: skipped file archived", ext)
+		}
+	}
+}
+
+func TestUnpackRefusesEscapes(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewTarGzWriter(&buf)
+	if err := w.AddBytes("../evil", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "evil.tar.gz")
+	if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Untar(archive, t.TempDir()); err == nil {
+		t.Errorf("file outside the destination unpacked")
+	}
+
+	srcDir := t.TempDir()
+	if err := os.Symlink("../../etc", filepath.Join(srcDir, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{".tar.gz", ".zip"} {
+		archive = filepath.Join(t.TempDir(), "link"+ext)
+		w, err := CreateArchive(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = w.AddTree(srcDir, "", nil); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		if err = UnpackingFile(archive, t.TempDir()); err == nil {
+			t.Errorf("%s: symlink outside the destination unpacked", ext)
+		}
+	}
+}
+
+func TestUnpackRefusesSymlinkChains(t *testing.T) {
+	type entry struct{ name, link string }
+	cases := [][]entry{
+		{{"l1", "."}, {"l1/l2", ".."}, {"l1/l2/escaped.txt", ""}},
+		{{"l1", "."}, {"out", "l1/../escaped.txt"}, {"out", ""}},
+	}
+	for i, entries := range cases {
+		dir := t.TempDir()
+		var tarBuf, zipBuf bytes.Buffer
+		gw := gzip.NewWriter(&tarBuf)
+		tw := tar.NewWriter(gw)
+		zw := zip.NewWriter(&zipBuf)
+		for _, e := range entries {
+			hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: 1}
+			zh := &zip.FileHeader{Name: e.name}
+			zh.SetMode(0644)
+			data := "x"
+			if e.link != "" {
+				hdr = &tar.Header{Name: e.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: e.link}
+				zh.SetMode(os.ModeSymlink | 0777)
+				data = e.link
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if e.link == "" {
+				tw.Write([]byte(data))
+			}
+			fw, err := zw.CreateHeader(zh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write([]byte(data))
+		}
+		tw.Close()
+		gw.Close()
+		zw.Close()
+		for ext, data := range map[string][]byte{".tar.gz": tarBuf.Bytes(), ".zip": zipBuf.Bytes()} {
+			archive := filepath.Join(dir, "chain"+ext)
+			if err := os.WriteFile(archive, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			dst := filepath.Join(dir, "dst"+strings.ReplaceAll(ext, ".", "-"), "target")
+			if err := UnpackingFile(archive, dst); err == nil {
+				t.Errorf("case %d %s: symlink chain unpacked", i, ext)
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(dst), "escaped.txt")); !os.IsNotExist(err) {
+				t.Errorf("case %d %s: file written outside the destination", i, ext)
+			}
+		}
+	}
+}
+
+func TestGzip(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "agent.log")
+	if err := os.WriteFile(src, []byte("line 1\nlast line without newline"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Gzip(src, src+".gz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnGzip(src+".gz", filepath.Join(dir, "out.log")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "out.log")); string(data) != "line 1\nlast line without newline" {
+		t.Errorf("round trip: %q", data)
+	}
+	if err := UnGzip(src, filepath.Join(dir, "bad.log")); err == nil {
+		t.Errorf("plain file decompressed")
+	}
+}
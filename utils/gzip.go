@@ -1,20 +1,20 @@
 package utils
 
 import (
-	"bufio"
 	"compress/gzip"
 	"io"
 	"os"
 )
 
-// 解压
+// UnGzip decompresses the gzip file src into dst.
 func UnGzip(src string, dst string) error {
 	gzipFile, err := os.Open(src)
 	if err != nil {
 		return err
 	}
+	defer gzipFile.Close()
 	gzipReader, err := gzip.NewReader(gzipFile)
-	if err == io.EOF {
+	if err != nil {
 		return err
 	}
 	defer gzipReader.Close()
@@ -23,31 +23,31 @@ func UnGzip(src string, dst string) error {
 	if err != nil {
 		return err
 	}
-	defer outfileWriter.Close()
-
 	_, err = io.Copy(outfileWriter, gzipReader)
-	if err != nil {
-		return err
+	if closeErr := outfileWriter.Close(); err == nil {
+		err = closeErr
 	}
-	return nil
+	return err
 }
 
-// 压缩
-func Gzip(file string, gzipWriter gzip.Writer) error {
-	readFile, err := os.Open(file)
+// Gzip compresses the file src into the gzip file dst.
+func Gzip(src string, dst string) error {
+	readFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer readFile.Close()
+	outfileWriter, err := os.Create(dst)
 	if err != nil {
 		return err
 	}
-	reader := bufio.NewReader(readFile)
-	for {
-		s, e := reader.ReadString('\n')
-		if e == io.EOF {
-			break
-		}
-		_, err := gzipWriter.Write([]byte(s))
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	gzipWriter := gzip.NewWriter(outfileWriter)
+	_, err = io.Copy(gzipWriter, readFile)
+	if gzErr := gzipWriter.Close(); err == nil {
+		err = gzErr
+	}
+	if closeErr := outfileWriter.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
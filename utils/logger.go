@@ -0,0 +1,284 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "DEBUG"
+	case InfoLevel:
+		return "INFO"
+	case WarnLevel:
+		return "WARN"
+	}
+	return "ERROR"
+}
+
+// Log formats
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
+// Logger writes leveled messages with key-value fields to the console and an optional log file
+type Logger struct {
+	mu     sync.Mutex
+	level  Level
+	format string
+	out    io.Writer
+	file   *RotatingFile
+	hooks  []Hook
+}
+
+// Hook is called with every message, whatever the level of the logger
+type Hook func(level Level, msg string, fields ...interface{})
+
+// NewLogger returns a text logger writing info and above to out
+func NewLogger(out io.Writer) *Logger {
+	return &Logger{level: InfoLevel, format: TextFormat, out: out}
+}
+
+var std = NewLogger(os.Stdout)
+
+// SetLevel sets the lowest level written
+func (l *Logger) SetLevel(level Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = level
+}
+
+// SetFormat sets the format of the messages, text or json
+func (l *Logger) SetFormat(format string) error {
+	if format != TextFormat && format != JSONFormat {
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.format = format
+	return nil
+}
+
+// SetOutput sets the console output
+func (l *Logger) SetOutput(out io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out = out
+}
+
+// SetFile writes the messages to the file too, the file is rotated at maxSize bytes
+func (l *Logger) SetFile(path string, maxSize int64, maxBackups int) error {
+	file, err := OpenRotatingFile(path, maxSize, maxBackups)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	return nil
+}
+
+// AddHook adds a hook called with every message
+func (l *Logger) AddHook(hook Hook) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, hook)
+}
+
+// Close closes the log file
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Log writes the message at level, fields are key-value pairs
+func (l *Logger) Log(level Level, msg string, fields ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, hook := range l.hooks {
+		hook(level, msg, fields...)
+	}
+	if level < l.level {
+		return
+	}
+	line := l.formatLine(time.Now(), level, msg, fields)
+	if l.out != nil {
+		l.out.Write(line)
+	}
+	if l.file != nil {
+		if _, err := l.file.Write(line); err != nil && l.out != nil {
+			fmt.Fprintf(l.out, "write log file: %s\n", err.Error())
+		}
+	}
+}
+
+func (l *Logger) formatLine(now time.Time, level Level, msg string, fields []interface{}) []byte {
+	if len(fields)%2 != 0 {
+		fields = append(fields, "")
+	}
+	if l.format == JSONFormat {
+		// Keep time, level and msg first
+		var b strings.Builder
+		b.WriteString(`{"time":`)
+		writeJSON(&b, now.Format(time.RFC3339))
+		b.WriteString(`,"level":`)
+		writeJSON(&b, strings.ToLower(level.String()))
+		b.WriteString(`,"msg":`)
+		writeJSON(&b, msg)
+		for i := 0; i < len(fields); i += 2 {
+			b.WriteString(",")
+			writeJSON(&b, fmt.Sprint(fields[i]))
+			b.WriteString(":")
+			writeJSON(&b, fieldValue(fields[i+1]))
+		}
+		b.WriteString("}\n")
+		return []byte(b.String())
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s [%s] %s", now.Format("2006-01-02 15:04:05"), level, oneLine(msg))
+	for i := 0; i < len(fields); i += 2 {
+		value := oneLine(fmt.Sprint(fieldValue(fields[i+1])))
+		if value == "" || strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&b, " %s=%s", fields[i], value)
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+// fieldValue turns errors into their message
+func fieldValue(value interface{}) interface{} {
+	if err, ok := value.(error); ok && err != nil {
+		return err.Error()
+	}
+	return value
+}
+
+func writeJSON(b *strings.Builder, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(data)
+}
+
+// oneLine replaces the line breaks and tabs with spaces
+func oneLine(s string) string {
+	return strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ", "\t", " ").Replace(s)
+}
+
+// Default returns the logger used by the package level functions
+func Default() *Logger {
+	return std
+}
+
+func Debug(msg string, fields ...interface{}) {
+	std.Log(DebugLevel, msg, fields...)
+}
+
+func Info(msg string, fields ...interface{}) {
+	std.Log(InfoLevel, msg, fields...)
+}
+
+func Warn(msg string, fields ...interface{}) {
+	std.Log(WarnLevel, msg, fields...)
+}
+
+func Error(msg string, fields ...interface{}) {
+	std.Log(ErrorLevel, msg, fields...)
+}
+
+// RotatingFile is a log file renamed to path.1, path.2 ... once it reaches maxSize bytes
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens the file for appending
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = fileInfo.Size()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) rotate() error {
+	err := r.file.Close()
+	if err != nil {
+		return err
+	}
+	if r.maxBackups > 0 {
+		for i := r.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		err = os.Rename(r.path, r.path+".1")
+	} else {
+		err = os.Remove(r.path)
+	}
+	if err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *RotatingFile) Close() error {
+	return r.file.Close()
+}
@@ -3,9 +3,10 @@ package utils
 import (
 	"archive/tar"
 	"compress/gzip"
+	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"time"
 )
 
 func ExistDir(dirname string) bool {
@@ -15,13 +16,15 @@ func ExistDir(dirname string) bool {
 	return (err == nil || os.IsExist(err)) && fi.IsDir()
 }
 
-// 解压
+// Untar unpacks the tar.gz src into dst with the permissions, symlinks and modification times.
+// Files which would land outside dst are refused.
 func Untar(src string, dst string) error {
 	// 打开待解压tar文件
 	fr, err := os.Open(src)
 	if err != nil {
 		return err
 	}
+	defer fr.Close()
 	// gzip解压，如未使用gzip可注释
 	gr, err := gzip.NewReader(fr)
 	if err != nil {
@@ -30,18 +33,22 @@ func Untar(src string, dst string) error {
 	defer gr.Close()
 	// tar 解压
 	tr := tar.NewReader(gr)
+	dirs := dirTimes{}
 	for {
 		hdr, err := tr.Next()
 		switch {
 		case err == io.EOF:
-			return nil // End of archive
+			return dirs.apply() // End of archive
 		case err != nil:
 			return err
 		case hdr == nil:
 			continue
 		}
 		// 设置保存路径为header中的name
-		dstFile := filepath.Join(dst, hdr.Name)
+		dstFile, err := extractPath(dst, hdr.Name)
+		if err != nil {
+			return err
+		}
 		// 判断文件类型
 		switch hdr.Typeflag {
 		case tar.TypeDir: // 是目录，创建目录
@@ -52,19 +59,111 @@ func Untar(src string, dst string) error {
 					return err
 				}
 			}
+			if err := os.Chmod(dstFile, os.FileMode(hdr.Mode).Perm()|0700); err != nil {
+				return err
+			}
+			dirs[dstFile] = hdr.ModTime
 		case tar.TypeReg: // 文件，写入
-			// 创建可读写文件
-			file, err := os.OpenFile(dstFile, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.FileMode(hdr.Mode))
-
-			if err != nil {
+			if err := extractFile(dstFile, tr, os.FileMode(hdr.Mode), hdr.ModTime); err != nil {
 				return err
 			}
-			_, err = io.Copy(file, tr)
-			if err != nil {
+			Debug("untar file", "file", dstFile)
+		case tar.TypeSymlink:
+			if err := extractSymlink(dst, dstFile, hdr.Linkname); err != nil {
 				return err
 			}
-			//fmt.Printf("untar %s, char %d\n", dstFile, n)
-			file.Close()
+		}
+	}
+}
+
+// TarGzWriter writes a tar.gz archive.
+type TarGzWriter struct {
+	closer io.Closer
+	gw     *gzip.Writer
+	tw     *tar.Writer
+}
+
+// NewTarGzWriter returns a writer of a tar.gz archive streamed to w.
+func NewTarGzWriter(w io.Writer) *TarGzWriter {
+	gw := gzip.NewWriter(w)
+	return &TarGzWriter{gw: gw, tw: tar.NewWriter(gw)}
+}
+
+// CreateTarGz creates the tar.gz archive dst.
+func CreateTarGz(dst string) (*TarGzWriter, error) {
+	file, err := os.Create(dst)
+	if err != nil {
+		return nil, err
+	}
+	w := NewTarGzWriter(file)
+	w.closer = file
+	return w, nil
+}
+
+// AddBytes adds a file named name holding data.
+func (w *TarGzWriter) AddBytes(name string, data []byte, mode os.FileMode) error {
+	err := w.tw.WriteHeader(&tar.Header{Name: name, Mode: int64(mode.Perm()), Size: int64(len(data)), ModTime: time.Now(), Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = w.tw.Write(data)
+	return err
+}
+
+// AddTree adds the directories, regular files and symlinks of srcDir under prefix.
+// skip is called with the path relative to srcDir, skipped directories are not walked.
+func (w *TarGzWriter) AddTree(srcDir string, prefix string, skip func(rel string) bool) error {
+	return walkTree(srcDir, prefix, skip, func(entry archiveEntry) error {
+		hdr, err := tar.FileInfoHeader(entry.Info, entry.Link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = entry.Name
+		err = w.tw.WriteHeader(hdr)
+		if err != nil || hdr.Typeflag != tar.TypeReg {
+			return err
+		}
+		return copyFile(w.tw, entry.Path)
+	})
+}
+
+// Close finishes the archive.
+func (w *TarGzWriter) Close() error {
+	err := w.tw.Close()
+	if gzErr := w.gw.Close(); err == nil {
+		err = gzErr
+	}
+	if w.closer != nil {
+		if closeErr := w.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// ReadTarGzFile returns the content of the file named name in the tar.gz archive src.
+func ReadTarGzFile(src string, name string) ([]byte, error) {
+	fr, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer fr.Close()
+	gr, err := gzip.NewReader(fr)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s not found in %s", name, src)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == name {
+			return io.ReadAll(tr)
 		}
 	}
 }
@@ -1,7 +1,12 @@
 package utils
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 	"strings"
 )
@@ -9,6 +14,7 @@ import (
 // UnpackingFile
 func UnpackingFile(src string, dst string) error {
 	_, filename := filepath.Split(src)
+	Debug("unpack file", "src", src, "dst", dst)
 	if strings.Contains(filename, ".zip") {
 		err := UnZip(src, dst)
 		if err != nil {
@@ -24,3 +30,45 @@ func UnpackingFile(src string, dst string) error {
 	}
 	return nil
 }
+
+// UnpackedSize returns the total size of the files in the package once unpacked
+func UnpackedSize(src string) (uint64, error) {
+	_, filename := filepath.Split(src)
+	if strings.Contains(filename, ".zip") {
+		r, err := zip.OpenReader(src)
+		if err != nil {
+			return 0, err
+		}
+		defer r.Close()
+		var size uint64
+		for _, f := range r.File {
+			size += f.UncompressedSize64
+		}
+		return size, nil
+	} else if strings.Contains(filename, ".tar.gz") {
+		fr, err := os.Open(src)
+		if err != nil {
+			return 0, err
+		}
+		defer fr.Close()
+		gr, err := gzip.NewReader(fr)
+		if err != nil {
+			return 0, err
+		}
+		defer gr.Close()
+		var size uint64
+		tr := tar.NewReader(gr)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return size, nil
+			} else if err != nil {
+				return 0, err
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				size += uint64(hdr.Size)
+			}
+		}
+	}
+	return 0, fmt.Errorf("unknown file format")
+}
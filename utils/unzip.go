@@ -4,64 +4,53 @@ import (
 	"archive/zip"
 	"io"
 	"os"
-	"path/filepath"
 )
 
+// UnZip unpacks the zip src into dst with the permissions, symlinks and modification times.
+// Files which would land outside dst are refused.
 func UnZip(src, dst string) error {
 	r, err := zip.OpenReader(src)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := r.Close(); err != nil {
-			panic(err)
-		}
-	}()
+	defer r.Close()
 
 	err = os.MkdirAll(dst, 0755)
 	if err != nil {
 		return err
 	}
 
+	dirs := dirTimes{}
 	// Closure to address file descriptors issue with all the deferred .Close() methods
 	extractAndWriteFile := func(f *zip.File) error {
-		rc, err := f.Open()
+		// Check for ZipSlip (Directory traversal)
+		path, err := extractPath(dst, f.Name)
 		if err != nil {
 			return err
 		}
-		defer func() {
-			if err := rc.Close(); err != nil {
-				panic(err)
-			}
-		}()
-
-		path := filepath.Join(dst, f.Name)
-
-		// Check for ZipSlip (Directory traversal)
-		//if !strings.HasPrefix(path, filepath.Clean(dst)+string(os.PathSeparator)) {
-		//return fmt.Errorf("illegal file path: %s", path)
-		//}
+		Debug("unzip file", "file", path)
 
 		if f.FileInfo().IsDir() {
-			os.MkdirAll(path, f.Mode())
-		} else {
-			os.MkdirAll(filepath.Dir(path), f.Mode())
-			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-			if err != nil {
-				return err
+			err = os.MkdirAll(path, 0755)
+			if err == nil {
+				err = os.Chmod(path, f.Mode().Perm()|0700)
 			}
-			defer func() {
-				if err := f.Close(); err != nil {
-					panic(err)
-				}
-			}()
-
-			_, err = io.Copy(f, rc)
+			dirs[path] = f.Modified
+			return err
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		if f.Mode()&os.ModeSymlink != 0 {
+			target, err := io.ReadAll(rc)
 			if err != nil {
 				return err
 			}
+			return extractSymlink(dst, path, string(target))
 		}
-		return nil
+		return extractFile(path, rc, f.Mode(), f.Modified)
 	}
 	for _, f := range r.File {
 		err := extractAndWriteFile(f)
@@ -69,5 +58,5 @@ func UnZip(src, dst string) error {
 			return err
 		}
 	}
-	return nil
+	return dirs.apply()
 }
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"time"
+)
+
+// ZipWriter writes a zip archive.
+type ZipWriter struct {
+	closer io.Closer
+	zw     *zip.Writer
+}
+
+// NewZipWriter returns a writer of a zip archive streamed to w.
+func NewZipWriter(w io.Writer) *ZipWriter {
+	return &ZipWriter{zw: zip.NewWriter(w)}
+}
+
+// CreateZip creates the zip archive dst.
+func CreateZip(dst string) (*ZipWriter, error) {
+	file, err := os.Create(dst)
+	if err != nil {
+		return nil, err
+	}
+	w := NewZipWriter(file)
+	w.closer = file
+	return w, nil
+}
+
+// AddBytes adds a file named name holding data.
+func (w *ZipWriter) AddBytes(name string, data []byte, mode os.FileMode) error {
+	hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()}
+	hdr.SetMode(mode.Perm())
+	fw, err := w.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(data)
+	return err
+}
+
+// AddTree adds the directories, regular files and symlinks of srcDir under prefix.
+// A symlink is stored as a file holding its target, with the symlink mode.
+// skip is called with the path relative to srcDir, skipped directories are not walked.
+func (w *ZipWriter) AddTree(srcDir string, prefix string, skip func(rel string) bool) error {
+	return walkTree(srcDir, prefix, skip, func(entry archiveEntry) error {
+		hdr, err := zip.FileInfoHeader(entry.Info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = entry.Name
+		if entry.Info.Mode().IsRegular() {
+			hdr.Method = zip.Deflate
+		}
+		fw, err := w.zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.Link != "":
+			_, err = io.WriteString(fw, entry.Link)
+			return err
+		case entry.Info.Mode().IsRegular():
+			return copyFile(fw, entry.Path)
+		}
+		return nil
+	})
+}
+
+// Close finishes the archive.
+func (w *ZipWriter) Close() error {
+	err := w.zw.Close()
+	if w.closer != nil {
+		if closeErr := w.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
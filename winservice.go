@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// WindowsServiceName is the service name used by zabbix_agentd.exe -i.
+const WindowsServiceName = "Zabbix Agent"
+
+// winServiceTimeout is how long to wait for a windows service to change its state
+const winServiceTimeout = 30 * time.Second
+
+// WinServiceAPI is the part of the windows service control manager used by WindowsManager.
+type WinServiceAPI interface {
+	// Exists returns true if the service is registered.
+	Exists(name string) (bool, error)
+	// Create registers an automatic start service running exePath with args.
+	Create(name string, displayName string, exePath string, args ...string) error
+	// Update makes the registered service run exePath with args as an automatic start service.
+	Update(name string, displayName string, exePath string, args ...string) error
+	// Delete unregisters the service.
+	Delete(name string) error
+	// Start starts the service.
+	Start(name string) error
+	// Stop stops the service and waits until it is stopped.
+	Stop(name string, timeout time.Duration) error
+	// Query returns the state of the service.
+	Query(name string) (ServiceStatus, error)
+	// List returns the names of the registered services.
+	List() ([]string, error)
+	// BinaryPath returns the command line of the service.
+	BinaryPath(name string) (string, error)
+}
+
+// FindWindowsService returns the name of the service running binAbsPath, or "" if there is none.
+func FindWindowsService(api WinServiceAPI, binAbsPath string) (string, error) {
+	names, err := api.List()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		cmdline, err := api.BinaryPath(name)
+		if err != nil {
+			continue
+		}
+		if IsSamePath(cmdlineExe(cmdline), binAbsPath) {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// cmdlineExe returns the executable of a windows command line, which may be quoted
+func cmdlineExe(cmdline string) string {
+	cmdline = strings.TrimSpace(cmdline)
+	if strings.HasPrefix(cmdline, `"`) {
+		if end := strings.Index(cmdline[1:], `"`); end != -1 {
+			return cmdline[1 : end+1]
+		}
+	}
+	return strings.Fields(cmdline + " ")[0]
+}
+
+// WindowsManager manages the agent with a windows service.
+// The service of the agent is found by its executable, other agents are left alone.
+type WindowsManager struct {
+	service *AgentService
+	API     WinServiceAPI
+}
+
+func NewWindowsManager(service *AgentService) *WindowsManager {
+	return &WindowsManager{service: service, API: NewSCMServiceAPI()}
+}
+
+func (m *WindowsManager) Name() string {
+	return "windows service"
+}
+
+// Install registers the service. The service of the same agent is stopped and updated in place,
+// a deleted service can not be created again until every handle to it is closed.
+// A service of the same name running another agent is an error.
+func (m *WindowsManager) Install() error {
+	// Same command line as zabbix_agentd.exe -i [-m]
+	args := []string{"--config", m.service.ConfPath}
+	if m.service.MultipleAgents {
+		args = append(args, "--multiple-agents")
+	}
+	name, err := m.serviceName()
+	if err != nil {
+		return err
+	}
+	if name == m.service.Name {
+		err = m.Stop()
+		if err != nil {
+			return err
+		}
+		return m.API.Update(name, name, m.service.BinPath, args...)
+	}
+	// The agent is registered under another name, -multiple-agents changed
+	err = m.Remove()
+	if err != nil {
+		return err
+	}
+	exists, err := m.API.Exists(m.service.Name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		cmdline, _ := m.API.BinaryPath(m.service.Name)
+		return fmt.Errorf("service %s already runs %s, use -multiple-agents", m.service.Name, cmdlineExe(cmdline))
+	}
+	return m.API.Create(m.service.Name, m.service.Name, m.service.BinPath, args...)
+}
+
+// serviceName returns the name of the service running the agent, or "" if it is not installed
+func (m *WindowsManager) serviceName() (string, error) {
+	return FindWindowsService(m.API, m.service.BinPath)
+}
+
+func (m *WindowsManager) Start() error {
+	name, err := m.serviceName()
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("no service runs %s", m.service.BinPath)
+	}
+	status, err := m.API.Query(name)
+	if err != nil {
+		return err
+	}
+	if status == ServiceRunning {
+		err = m.API.Stop(name, winServiceTimeout)
+		if err != nil {
+			return err
+		}
+	}
+	return m.API.Start(name)
+}
+
+func (m *WindowsManager) Stop() error {
+	name, err := m.serviceName()
+	if err != nil || name == "" {
+		return err
+	}
+	status, err := m.API.Query(name)
+	if err != nil || status != ServiceRunning {
+		return err
+	}
+	return m.API.Stop(name, winServiceTimeout)
+}
+
+func (m *WindowsManager) Status() (ServiceStatus, error) {
+	name, err := m.serviceName()
+	if err != nil {
+		return ServiceUnknown, err
+	}
+	if name == "" {
+		return ServiceNotInstalled, nil
+	}
+	return m.API.Query(name)
+}
+
+func (m *WindowsManager) Remove() error {
+	err := m.Stop()
+	if err != nil {
+		return err
+	}
+	name, err := m.serviceName()
+	if err != nil || name == "" {
+		return err
+	}
+	return m.API.Delete(name)
+}
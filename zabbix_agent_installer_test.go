@@ -1,13 +1,21 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+	"zabbix_agent_installer/utils"
 )
 
 func TestGetRunTimeProcessList(t *testing.T) {
@@ -32,45 +40,96 @@ func TestContainsAnd(t *testing.T) {
 
 }
 
-func TestCheckProcess(t *testing.T) {
-	go func() {
-		for {
-			fmt.Println("Checking")
-			time.Sleep(1 * time.Second)
+// fakeCrontab installs a fake crontab command which keeps the crontab in a file
+func fakeCrontab(t *testing.T, cron string) string {
+	t.Helper()
+	binDir := t.TempDir()
+	cronAbsPath := filepath.Join(binDir, "crontab.txt")
+	if cron != "" {
+		err := os.WriteFile(cronAbsPath, []byte(cron), 0644)
+		if err != nil {
+			t.Fatal(err)
 		}
-	}()
-	err := ShowAgentProcess()
-	if err != nil {
-		return
 	}
-	t.Log("check ok")
+	writeFakeCommand(t, binDir, "crontab", `if [ "$1" = "-l" ]; then
+	[ -f "`+cronAbsPath+`" ] || { echo "no crontab for test" >&2; exit 1; }
+	cat "`+cronAbsPath+`"
+	exit 0
+fi
+cat "$1" > "`+cronAbsPath+`"
+`)
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return cronAbsPath
 }
 
-func TestWriteCrontab(t *testing.T) {
-	// Get the source cron
-	cmd := exec.Command("crontab", "-l")
-	output, _ := cmd.Output()
-	t.Logf(string(output))
-
-	f := bytes.NewReader(output)
-	br := bufio.NewReader(f)
-	for {
-		line, err := br.ReadString('\n')
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			t.Log(err.Error())
-		}
-		t.Logf(line)
+func TestReadCrontab(t *testing.T) {
+	fakeCrontab(t, "")
+	cron, err := ReadCrontab("")
+	if err != nil || cron != "" {
+		t.Fatalf("missing crontab: %q, %v", cron, err)
 	}
 }
 
-func TestWriteCrontab1(t *testing.T) {
+func TestSetCronEntry(t *testing.T) {
+	script := "/opt/zabbix_agentd/zabbix_script.sh"
+	cronAbsPath := fakeCrontab(t, "MAILTO=ops\n0 1 * * * /usr/bin/backup\n")
 
-	cron := "*/10 * * * * /bin/sh /home/test/zabbix_agentd/zabbix_script.sh daemon 2>&1 > /dev/null\n"
-	err := WriteCrontab(cron)
+	err := SetCronEntry("", script, CronEntry(DefaultCronSchedule, script))
 	if err != nil {
-		t.Logf(err.Error())
+		t.Fatal(err)
+	}
+	// Update the schedule, the entry must not be duplicated
+	err = SetCronEntry("", script, CronEntry("*/5 * * * *", script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron, _ := os.ReadFile(cronAbsPath)
+	want := "MAILTO=ops\n0 1 * * * /usr/bin/backup\n" +
+		"# zabbix_agent_installer: /opt/zabbix_agentd/zabbix_script.sh\n" +
+		"*/5 * * * * /bin/sh /opt/zabbix_agentd/zabbix_script.sh daemon > /dev/null 2>&1\n"
+	if string(cron) != want {
+		t.Errorf("crontab:\n%s\nwant:\n%s", cron, want)
+	}
+	entry, ok, err := FindCronEntry("", script)
+	if err != nil || !ok || entry != CronEntry("*/5 * * * *", script) {
+		t.Errorf("find entry: %q, %v, %v", entry, ok, err)
+	}
+
+	err = RemoveCronEntry("", script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron, _ = os.ReadFile(cronAbsPath)
+	if string(cron) != "MAILTO=ops\n0 1 * * * /usr/bin/backup\n" {
+		t.Errorf("crontab after remove:\n%s", cron)
+	}
+}
+
+func TestCrontabArgs(t *testing.T) {
+	defer func() { getuid = os.Getuid }()
+	getuid = func() int { return 0 }
+	if args := crontabArgs("zabbix", "-l"); strings.Join(args, " ") != "-u zabbix -l" {
+		t.Errorf("root edits the crontab of zabbix with: %v", args)
+	}
+	if args := crontabArgs("root", "-l"); strings.Join(args, " ") != "-l" {
+		t.Errorf("root edits its own crontab with: %v", args)
+	}
+	getuid = func() int { return 1000 }
+	if args := crontabArgs("zabbix", "-l"); strings.Join(args, " ") != "-l" {
+		t.Errorf("normal user edits its own crontab with: %v", args)
+	}
+}
+
+func TestSetCronEntryKeepsOtherAgents(t *testing.T) {
+	script := "/opt/a/zabbix_agentd/zabbix_script.sh"
+	legacy := "*/10 * * * * /bin/sh /opt/a/zabbix_agentd/zabbix_script.sh daemon 2>&1 > /dev/null\n"
+	other := "# zabbix_agent_installer: /opt/b/zabbix_agentd/zabbix_script.sh\n" +
+		"*/10 * * * * /bin/sh /opt/b/zabbix_agentd/zabbix_script.sh daemon > /dev/null 2>&1\n" +
+		"*/10 * * * * /bin/sh /home/x/opt/a/zabbix_agentd/zabbix_script.sh daemon > /dev/null 2>&1\n"
+	cron := setCronEntry(legacy+other, script, CronEntry(DefaultCronSchedule, script))
+	want := other + cronMarker + script + "\n" + CronEntry(DefaultCronSchedule, script) + "\n"
+	if cron != want {
+		t.Errorf("crontab:\n%s\nwant:\n%s", cron, want)
 	}
 }
 
@@ -95,3 +154,1560 @@ func TestGetAgentDir(t *testing.T) {
 	agentDirHandler(config)
 	t.Log(config.AgentDir)
 }
+
+// writeFakeCommand writes a shell script named name into dir
+func writeFakeCommand(t *testing.T, dir string, name string, script string) {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSystemdManager(t *testing.T) {
+	binDir := t.TempDir()
+	t.Setenv("PATH", binDir)
+	callsAbsPath := filepath.Join(binDir, "calls")
+	writeFakeCommand(t, binDir, "systemctl", "echo \"$@\" >> "+callsAbsPath+"\n[ \"$1\" = is-active ] && echo active\nexit 0\n")
+
+	service := NewAgentService(&Config{AgentUser: "zabbix"}, &PathConfig{
+		ZabbixAgentDirAbsPath:  "/opt/zabbix_agentd",
+		ZabbixAgentBinAbsPath:  "/opt/zabbix_agentd/sbin/zabbix_agentd",
+		ZabbixAgentConfAbsPath: "/opt/zabbix_agentd/etc/zabbix_agentd.conf",
+	})
+	manager := NewSystemdManager(service)
+	manager.UnitDir = t.TempDir()
+
+	status, err := manager.Status()
+	if err != nil || status != ServiceNotInstalled {
+		t.Fatalf("status before install: %v, %v", status, err)
+	}
+	if err = manager.Install(); err != nil {
+		t.Fatal(err)
+	}
+	unit, err := os.ReadFile(filepath.Join(manager.UnitDir, "zabbix_agentd.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(unit), "User=zabbix\n") {
+		t.Errorf("unit does not run as zabbix:\n%s", unit)
+	}
+	if !strings.Contains(string(unit), "ExecStart=/opt/zabbix_agentd/sbin/zabbix_agentd -c /opt/zabbix_agentd/etc/zabbix_agentd.conf -f") {
+		t.Errorf("unexpected unit:\n%s", unit)
+	}
+	status, err = manager.Status()
+	if err != nil || status != ServiceRunning {
+		t.Fatalf("status after install: %v, %v", status, err)
+	}
+	if err = manager.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	calls, _ := os.ReadFile(callsAbsPath)
+	want := "daemon-reload\nenable zabbix_agentd\nis-active zabbix_agentd\ndisable --now zabbix_agentd\ndaemon-reload\n"
+	if string(calls) != want {
+		t.Errorf("systemctl calls:\n%s\nwant:\n%s", calls, want)
+	}
+}
+
+func TestIsFileNotExist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "zabbix_agentd.conf")
+	if !IsFileNotExist(file) {
+		t.Errorf("missing file exists")
+	}
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if IsFileNotExist(file) {
+		t.Errorf("file does not exist")
+	}
+	// stat fails with ENOTDIR
+	if !IsFileNotExist(filepath.Join(file, "sbin")) {
+		t.Errorf("path under a file exists")
+	}
+}
+
+func TestIsSamePath(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "sbin", "zabbix_agentd")
+	if err := os.MkdirAll(filepath.Dir(bin), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bin, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(t.TempDir(), "opt")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{bin, filepath.Join(dir, "sbin", "..", "sbin", "zabbix_agentd"), filepath.Join(link, "sbin", "zabbix_agentd")} {
+		if !IsSamePath(path, bin) {
+			t.Errorf("%s is not %s", path, bin)
+		}
+	}
+	if IsSamePath(filepath.Join(dir, "zabbix_agentd"), bin) || IsSamePath("", bin) {
+		t.Errorf("other path is the agent")
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	t.Setenv("AGENT_BASE", "/srv")
+	dir, err := ExpandPath("$AGENT_BASE/zabbix")
+	if err != nil || dir != "/srv/zabbix" {
+		t.Errorf("expand env: %s, %v", dir, err)
+	}
+	home, _ := GetUserHomePath()
+	dir, err = ExpandPath("~/agents")
+	if err != nil || dir != filepath.Join(home, "agents") {
+		t.Errorf("expand home: %s, %v", dir, err)
+	}
+}
+
+func TestPreflightExitCode(t *testing.T) {
+	pass := CheckResult{"os", CheckPass, ""}
+	warn := CheckResult{"clock", CheckWarn, ""}
+	fail := CheckResult{"server", CheckFail, ""}
+	cases := []struct {
+		results []CheckResult
+		want    int
+	}{
+		{[]CheckResult{pass}, ExitOK},
+		{[]CheckResult{pass, warn}, ExitWarning},
+		{[]CheckResult{warn, fail, pass}, ExitFailure},
+		{[]CheckResult{pass, {"clock", CheckSkip, ""}}, ExitOK},
+	}
+	for _, c := range cases {
+		if got := PreflightExitCode(c.results); got != c.want {
+			t.Errorf("exit code of %v: %d, want %d", c.results, got, c.want)
+		}
+	}
+}
+
+func TestCheckClock(t *testing.T) {
+	binDir := t.TempDir()
+	t.Setenv("PATH", binDir)
+	if result := checkClock(&Config{}); result.Status != CheckSkip {
+		t.Errorf("clock without time source: %v", result)
+	}
+	writeFakeCommand(t, binDir, "timedatectl", "echo no\n")
+	if result := checkClock(&Config{}); result.Status != CheckWarn {
+		t.Errorf("clock not synchronized: %v", result)
+	}
+	writeFakeCommand(t, binDir, "timedatectl", "echo yes\n")
+	if result := checkClock(&Config{}); result.Status != CheckPass {
+		t.Errorf("clock synchronized: %v", result)
+	}
+}
+
+func TestAgentConfSet(t *testing.T) {
+	conf := ParseAgentConf([]byte("# Default:\n# ListenPort=10050\n\nServer=127.0.0.1\nHostname=a\nHostname=b\n"))
+	conf.Set("ListenPort", "10060")
+	conf.Set("Hostname", "web01")
+	conf.Set("Timeout", "10")
+	want := "# Default:\n# ListenPort=10050\nListenPort=10060\n\nServer=127.0.0.1\nHostname=web01\nTimeout=10\n"
+	if string(conf.Bytes()) != want {
+		t.Errorf("conf:\n%s\nwant:\n%s", conf.Bytes(), want)
+	}
+	if port, ok := conf.Get("ListenPort"); !ok || port != "10060" {
+		t.Errorf("ListenPort: %s, %v", port, ok)
+	}
+}
+
+func TestFindFreePort(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	if IsPortFree(port) {
+		t.Errorf("port %s is in use", port)
+	}
+	newPort, err := FindFreePort(port)
+	if err != nil || newPort == port {
+		t.Errorf("free port after %s: %s, %v", port, newPort, err)
+	}
+}
+
+func TestAgentIPDetection(t *testing.T) {
+	ip, err := GetMainIP("127.0.0.1", "10051")
+	if err != nil || ip != "127.0.0.1" {
+		t.Errorf("ip routing to 127.0.0.1: %s, %v", ip, err)
+	}
+	ip, err = GetSubnetIP("127.0.0.0/8")
+	if err != nil || ip != "127.0.0.1" {
+		t.Errorf("ip in 127.0.0.0/8: %s, %v", ip, err)
+	}
+	if _, err = GetSubnetIP("203.0.113.252/30"); err == nil {
+		t.Error("no address expected in 203.0.113.252/30")
+	}
+}
+
+func TestHostnameHandler(t *testing.T) {
+	config := &Config{AgentIP: "10.0.0.5", Hostname: "ip"}
+	if err := hostnameHandler(config); err != nil || config.Hostname != "10.0.0.5" {
+		t.Errorf("ip hostname: %s, %v", config.Hostname, err)
+	}
+	config = &Config{AgentIP: "10.0.0.5", Hostname: "short"}
+	if err := hostnameHandler(config); err != nil || strings.Contains(config.Hostname, ".") {
+		t.Errorf("short hostname: %s, %v", config.Hostname, err)
+	}
+	config = &Config{AgentIP: "fd00::2", Hostname: "ip"}
+	if err := hostnameHandler(config); err != nil || config.Hostname != "fd00--2" {
+		t.Errorf("ipv6 hostname: %s, %v", config.Hostname, err)
+	}
+	config = &Config{Hostname: "web 01;rm"}
+	if err := hostnameHandler(config); err == nil {
+		t.Error("invalid hostname accepted")
+	}
+}
+
+func TestHostAddress(t *testing.T) {
+	for _, address := range []string{"10.0.0.1", "::1", "fd00::2", "zabbix-proxy.dc1.example.com", "zabbix"} {
+		if !IsHostAddress(address) {
+			t.Errorf("%s is a valid address", address)
+		}
+	}
+	for _, address := range []string{"", "-bad.example.com", "a b", "10.0.0.1:10051"} {
+		if IsHostAddress(address) {
+			t.Errorf("%s is not a valid address", address)
+		}
+	}
+	if got := FormatServerActive("::1", "10051"); got != "[::1]:10051" {
+		t.Errorf("IPv6 ServerActive: %s", got)
+	}
+	if got := FormatServerActive("zabbix.example.com", "10051"); got != "zabbix.example.com:10051" {
+		t.Errorf("DNS ServerActive: %s", got)
+	}
+	if got := TrimBrackets("[fd00::2]"); got != "fd00::2" {
+		t.Errorf("trim brackets: %s", got)
+	}
+}
+
+func TestProbeHost(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	reachable, _ := ProbeHost("localhost", port)
+	if len(reachable) == 0 || IsUnreachable("localhost", port) {
+		t.Errorf("localhost:%s is reachable", port)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := utils.NewLogger(&buf)
+	logger.Log(utils.DebugLevel, "hidden")
+	logger.Log(utils.InfoLevel, "start agent", "pid", 42)
+	if !strings.Contains(buf.String(), "[INFO] start agent pid=42\n") || strings.Contains(buf.String(), "hidden") {
+		t.Errorf("text log: %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := logger.SetFormat(utils.JSONFormat); err != nil {
+		t.Fatal(err)
+	}
+	logger.Log(utils.WarnLevel, "port in use", "port", "10050", "error", fmt.Errorf("busy"))
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("json log %q: %v", buf.String(), err)
+	}
+	if entry["level"] != "warn" || entry["msg"] != "port in use" || entry["port"] != "10050" || entry["error"] != "busy" {
+		t.Errorf("json log: %v", entry)
+	}
+}
+
+func TestLoggerRotation(t *testing.T) {
+	logAbsPath := filepath.Join(t.TempDir(), "installer.log")
+	logger := utils.NewLogger(nil)
+	if err := logger.SetFile(logAbsPath, 100, 2); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		logger.Log(utils.InfoLevel, "rotate the log file", "line", i)
+	}
+	logger.Close()
+	for _, name := range []string{logAbsPath, logAbsPath + ".1", logAbsPath + ".2"} {
+		if IsFileNotExist(name) {
+			t.Errorf("%s missing", name)
+		}
+	}
+	if !IsFileNotExist(logAbsPath + ".3") {
+		t.Errorf("only 2 backups are kept")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	if code := ExitCode(nil); code != ExitOK {
+		t.Errorf("nil error exit code: %d", code)
+	}
+	if code := ExitCode(fmt.Errorf("boom")); code != ExitFailure {
+		t.Errorf("unknown error exit code: %d", code)
+	}
+	err := NewError(ServiceError, Errorf(NetworkError, "connect to %s failed", "10.0.0.1:10051"))
+	if code := ExitCode(err); code != ExitNetwork {
+		t.Errorf("network error exit code: %d", code)
+	}
+	err = fmt.Errorf("install: %w", NewError(PackageError, fmt.Errorf("unknown file format")))
+	if GetErrorKind(err) != PackageError || ExitCode(err) != ExitPackage {
+		t.Errorf("wrapped package error: %v, %d", GetErrorKind(err), ExitCode(err))
+	}
+}
+
+func TestDownloadPackageStatus(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	config := &Config{PackageURL: server.URL + "/zabbix_agent.tar.gz", AgentDir: t.TempDir()}
+	err := packageURLHandler(config)
+	if err == nil {
+		t.Fatal("404 page downloaded as the package")
+	}
+	if !IsFileNotExist(filepath.Join(config.AgentDir, "zabbix_agent.tar.gz")) {
+		t.Errorf("package file left")
+	}
+}
+
+func TestProcessConfigErrorKind(t *testing.T) {
+	config := &Config{ServerIP: "not a server"}
+	if kind := GetErrorKind(ProcessConfig(config)); kind != ValidationError {
+		t.Errorf("invalid server ip error kind: %s", kind)
+	}
+}
+
+func TestResult(t *testing.T) {
+	result := NewResult("install", &Config{ServerIP: "192.0.2.10"})
+	result.Step("read os info", func() error { return nil })
+	result.Skip("create user")
+	err := result.Step("unpack package", func() error { return Errorf(PackageError, "unknown file format") })
+	utils.Default().SetOutput(io.Discard)
+	utils.Warn("listen port is in use", "port", "10050")
+	utils.Default().SetOutput(os.Stdout)
+	result.Finish(ExitCode(err), err)
+
+	var buf bytes.Buffer
+	if err := result.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["success"] != false || doc["exit_code"] != float64(ExitPackage) {
+		t.Errorf("success and exit code: %v %v", doc["success"], doc["exit_code"])
+	}
+	if kind := doc["error"].(map[string]interface{})["kind"]; kind != "package" {
+		t.Errorf("error kind: %v", kind)
+	}
+	if ip := doc["config"].(map[string]interface{})["server_ip"]; ip != "192.0.2.10" {
+		t.Errorf("config server_ip: %v", ip)
+	}
+	var statuses []string
+	for _, step := range doc["steps"].([]interface{}) {
+		statuses = append(statuses, step.(map[string]interface{})["status"].(string))
+	}
+	if strings.Join(statuses, ",") != "ok,skipped,failed" {
+		t.Errorf("step statuses: %v", statuses)
+	}
+	if warnings := doc["warnings"].([]interface{}); len(warnings) != 1 || warnings[0] != "listen port is in use port=10050" {
+		t.Errorf("warnings: %v", warnings)
+	}
+}
+
+func TestNewPackageInfo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zabbix_agent-6.0.13-linux-3.0-amd64-static.tar.gz")
+	if err := os.WriteFile(path, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := NewPackageInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "6.0.13" {
+		t.Errorf("version: %s", info.Version)
+	}
+	if info.Checksum != "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Errorf("checksum: %s", info.Checksum)
+	}
+}
+
+func TestTailFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zabbix_agentd.log")
+	var lines []string
+	for i := 0; i < 20000; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := TailFile(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tail, ",") != "line 19997,line 19998,line 19999" {
+		t.Errorf("tail: %v", tail)
+	}
+}
+
+func TestReadAgentStatus(t *testing.T) {
+	config := &Config{OSType: "linux", AgentDir: t.TempDir()}
+	pathConfig := &PathConfig{}
+	SetAgentPaths(config, pathConfig)
+	for _, path := range []string{pathConfig.ZabbixAgentBinAbsPath, pathConfig.ZabbixAgentConfAbsPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFakeCommand(t, filepath.Dir(pathConfig.ZabbixAgentBinAbsPath), "zabbix_agentd", "echo 'zabbix_agentd (daemon) (Zabbix) 6.0.13'; echo 'Revision 123'")
+	logFile := filepath.Join(pathConfig.ZabbixAgentDirAbsPath, "zabbix_agentd.log")
+	if err := os.WriteFile(logFile, []byte("started\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := "Server=192.0.2.10\nServerActive=[::1]:1\nHostname=web01\nLogFile=" + logFile + "\n"
+	if err := os.WriteFile(pathConfig.ZabbixAgentConfAbsPath, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	agentStatus, err := ReadAgentStatus(config, pathConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agentStatus.Version != "6.0.13" {
+		t.Errorf("version: %s", agentStatus.Version)
+	}
+	if agentStatus.Conf["Hostname"] != "web01" {
+		t.Errorf("conf: %v", agentStatus.Conf)
+	}
+	if len(agentStatus.Processes) != 0 {
+		t.Errorf("processes: %v", agentStatus.Processes)
+	}
+	if strings.Join(agentStatus.LogTail, ",") != "started" {
+		t.Errorf("log tail: %v", agentStatus.LogTail)
+	}
+	if agentStatus.Server != "[::1]:1" {
+		t.Errorf("server: %s", agentStatus.Server)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	a := []string{"# comment", "Server=10.0.0.1", "Hostname=web01", ""}
+	b := []string{"# comment", "Server=10.0.0.2", "Hostname=web01", "Timeout=10", ""}
+	diff := DiffLines(a, b)
+	if strings.Join(diff, "|") != "-Server=10.0.0.1|+Server=10.0.0.2|+Timeout=10" {
+		t.Errorf("diff: %v", diff)
+	}
+	if diff := DiffLines(a, a); len(diff) != 0 {
+		t.Errorf("diff of equal lines: %v", diff)
+	}
+}
+
+func TestValidateConfParams(t *testing.T) {
+	valid := []ConfParam{
+		{"Server", "192.0.2.10,10.0.0.0/8,zabbix.example.com"},
+		{"ServerActive", "[fd00::10]:10051,zabbix.example.com"},
+		{"Hostname", "web01"},
+		{"ListenPort", "10050"},
+		{"Timeout", "10"},
+	}
+	if err := ValidateConfParams(valid); err != nil {
+		t.Errorf("valid params: %s", err.Error())
+	}
+	for _, param := range []ConfParam{
+		{"Server", "not a server"},
+		{"ServerActive", "192.0.2.10:70000"},
+		{"Hostname", "web/01"},
+		{"ListenPort", "80"},
+		{"Bad Key", "1"},
+		{"Timeout", "10\nServer=192.0.2.66"},
+	} {
+		if err := ValidateConfParams([]ConfParam{param}); err == nil {
+			t.Errorf("invalid param accepted: %v", param)
+		}
+	}
+}
+
+func TestConfigureParams(t *testing.T) {
+	config := &Config{ConfParams: []string{"Timeout=10", " HostMetadata = linux web "}}
+	params, err := ConfigureParams(config, ParseAgentConf(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(params) != "[{Timeout 10} {HostMetadata linux web}]" {
+		t.Errorf("params: %v", params)
+	}
+	config.ConfParams = []string{"Timeout"}
+	if _, err := ConfigureParams(config, ParseAgentConf(nil)); GetErrorKind(err) != ValidationError {
+		t.Errorf("invalid -set error: %v", err)
+	}
+}
+
+// fakeWinServiceAPI is an in-memory service control manager
+type fakeWinServiceAPI struct {
+	services map[string]ServiceStatus
+	cmdlines map[string]string
+	calls    []string
+}
+
+func newFakeWinServiceAPI() *fakeWinServiceAPI {
+	return &fakeWinServiceAPI{services: map[string]ServiceStatus{}, cmdlines: map[string]string{}}
+}
+
+func (f *fakeWinServiceAPI) Exists(name string) (bool, error) {
+	_, ok := f.services[name]
+	return ok, nil
+}
+
+func (f *fakeWinServiceAPI) Create(name string, displayName string, exePath string, args ...string) error {
+	f.calls = append(f.calls, "create")
+	f.services[name] = ServiceStopped
+	f.cmdlines[name] = strings.Join(append([]string{`"` + exePath + `"`}, args...), " ")
+	return nil
+}
+
+func (f *fakeWinServiceAPI) Update(name string, displayName string, exePath string, args ...string) error {
+	f.calls = append(f.calls, "update")
+	f.cmdlines[name] = strings.Join(append([]string{`"` + exePath + `"`}, args...), " ")
+	return nil
+}
+
+func (f *fakeWinServiceAPI) Delete(name string) error {
+	f.calls = append(f.calls, "delete")
+	delete(f.services, name)
+	return nil
+}
+
+func (f *fakeWinServiceAPI) Start(name string) error {
+	f.calls = append(f.calls, "start")
+	f.services[name] = ServiceRunning
+	return nil
+}
+
+func (f *fakeWinServiceAPI) Stop(name string, timeout time.Duration) error {
+	f.calls = append(f.calls, "stop")
+	f.services[name] = ServiceStopped
+	return nil
+}
+
+func (f *fakeWinServiceAPI) Query(name string) (ServiceStatus, error) {
+	return f.services[name], nil
+}
+
+func (f *fakeWinServiceAPI) List() ([]string, error) {
+	var names []string
+	for name := range f.services {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (f *fakeWinServiceAPI) BinaryPath(name string) (string, error) {
+	return f.cmdlines[name], nil
+}
+
+func TestWindowsManager(t *testing.T) {
+	config := &Config{OSType: "windows", AgentDir: `C:\zabbix_agent`}
+	pathConfig := &PathConfig{}
+	SetAgentPaths(config, pathConfig)
+	api := newFakeWinServiceAPI()
+	manager := &WindowsManager{service: NewAgentService(config, pathConfig), API: api}
+
+	if status, _ := manager.Status(); status != ServiceNotInstalled {
+		t.Errorf("status before install: %s", status)
+	}
+	if err := manager.Start(); err == nil {
+		t.Errorf("start of a missing service succeeded")
+	}
+	for _, step := range []func() error{manager.Install, manager.Start, manager.Start, manager.Install} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The second start restarts, the second install stops and updates the running service
+	if calls := strings.Join(api.calls, ","); calls != "create,start,stop,start,stop,update" {
+		t.Errorf("calls: %s", calls)
+	}
+	want := `"` + pathConfig.ZabbixAgentBinAbsPath + `" --config ` + pathConfig.ZabbixAgentConfAbsPath
+	if cmdline := api.cmdlines[WindowsServiceName]; cmdline != want {
+		t.Errorf("command line: %s", cmdline)
+	}
+	if err := manager.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := manager.Status(); status != ServiceNotInstalled {
+		t.Errorf("status after remove: %s", status)
+	}
+}
+
+func TestWindowsMultipleAgents(t *testing.T) {
+	api := newFakeWinServiceAPI()
+	api.services[WindowsServiceName] = ServiceRunning
+	api.cmdlines[WindowsServiceName] = `"C:\proxy1\zabbix\bin\zabbix_agentd.exe" --config C:\proxy1\zabbix\conf\zabbix_agentd.conf`
+
+	config := &Config{OSType: "windows", AgentDir: `C:\proxy2`, Hostname: "web01"}
+	pathConfig := &PathConfig{}
+	SetAgentPaths(config, pathConfig)
+	manager := &WindowsManager{service: NewAgentService(config, pathConfig), API: api}
+	if status, _ := manager.Status(); status != ServiceNotInstalled {
+		t.Errorf("status of the other agent: %s", status)
+	}
+	if err := manager.Install(); err == nil {
+		t.Errorf("install replaced the service of another agent")
+	}
+
+	config.MultipleAgents = true
+	manager = &WindowsManager{service: NewAgentService(config, pathConfig), API: api}
+	if err := manager.Install(); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	name := WindowsServiceName + " [web01]"
+	if !strings.HasSuffix(api.cmdlines[name], " --multiple-agents") {
+		t.Errorf("command line: %s", api.cmdlines[name])
+	}
+	if api.services[WindowsServiceName] != ServiceRunning {
+		t.Errorf("the other agent was stopped")
+	}
+}
+
+func TestLinuxMultipleAgentsServiceName(t *testing.T) {
+	config := &Config{OSType: "linux", AgentDir: "/opt/proxy 1", Hostname: "web01", MultipleAgents: true}
+	pathConfig := &PathConfig{}
+	SetAgentPaths(config, pathConfig)
+	if name := NewAgentService(config, pathConfig).Name; name != "zabbix_agentd_proxy_1" {
+		t.Errorf("service name: %s", name)
+	}
+}
+
+// testAgentService returns the service of the agent in /opt/zabbix_agentd run as zabbix
+func testAgentService() *AgentService {
+	return NewAgentService(&Config{AgentUser: "zabbix"}, &PathConfig{
+		ZabbixAgentDirAbsPath:  "/opt/zabbix_agentd",
+		ZabbixAgentBinAbsPath:  "/opt/zabbix_agentd/sbin/zabbix_agentd",
+		ZabbixAgentConfAbsPath: "/opt/zabbix_agentd/etc/zabbix_agentd.conf",
+	})
+}
+
+// fakeCommands installs commands which log their name and arguments into the returned file
+// and run script, the PATH only holds them
+func fakeCommands(t *testing.T, script string, names ...string) string {
+	t.Helper()
+	binDir := t.TempDir()
+	t.Setenv("PATH", binDir)
+	callsAbsPath := filepath.Join(binDir, "calls")
+	for _, name := range names {
+		writeFakeCommand(t, binDir, name, "echo "+name+" \"$@\" >> "+callsAbsPath+"\n"+script)
+	}
+	return callsAbsPath
+}
+
+func TestSysVManager(t *testing.T) {
+	sleepAbsPath, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep not found")
+	}
+	// the init script needs the shell tools, the fake commands come first
+	path := os.Getenv("PATH")
+	callsAbsPath := fakeCommands(t, "exit 0\n", "chkconfig")
+	t.Setenv("PATH", filepath.Dir(callsAbsPath)+string(os.PathListSeparator)+path)
+	dir := t.TempDir()
+	pidAbsPath := filepath.Join(dir, "zabbix_agentd.pid")
+	service := testAgentService()
+	service.ConfPath = filepath.Join(dir, "zabbix_agentd.conf")
+	if err = os.WriteFile(service.ConfPath, []byte("PidFile="+pidAbsPath+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manager := NewSysVManager(service)
+	manager.InitDir = t.TempDir()
+	if status, err := manager.Status(); err != nil || status != ServiceNotInstalled {
+		t.Fatalf("status before install: %v, %v", status, err)
+	}
+	if err = manager.Install(); err != nil {
+		t.Fatal(err)
+	}
+	script, err := os.ReadFile(filepath.Join(manager.InitDir, "zabbix_agentd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# Provides:          zabbix_agentd\n", "DAEMON=\"/opt/zabbix_agentd/sbin/zabbix_agentd\"\n", "CONF=\"" + service.ConfPath + "\"\n", "RUN_USER=\"zabbix\"\n"} {
+		if !strings.Contains(string(script), want) {
+			t.Errorf("init script without %q:\n%s", want, script)
+		}
+	}
+	if status, err := manager.Status(); err != nil || status != ServiceStopped {
+		t.Fatalf("status after install: %v, %v", status, err)
+	}
+
+	// a process in the PidFile stands for the agent, the stop waits for it to exit
+	agent := exec.Command(sleepAbsPath, "30")
+	if err = agent.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { agent.Process.Kill() })
+	exited := make(chan error, 1)
+	go func() { exited <- agent.Wait() }()
+	if err = os.WriteFile(pidAbsPath, []byte(strconv.Itoa(agent.Process.Pid)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := manager.Status(); err != nil || status != ServiceRunning {
+		t.Fatalf("status of the agent: %v, %v", status, err)
+	}
+	if err = manager.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Errorf("agent not stopped")
+	}
+	if !IsFileNotExist(filepath.Join(manager.InitDir, "zabbix_agentd")) {
+		t.Errorf("init script not removed")
+	}
+	calls, _ := os.ReadFile(callsAbsPath)
+	want := "chkconfig --add zabbix_agentd\nchkconfig --del zabbix_agentd\n"
+	if string(calls) != want {
+		t.Errorf("calls:\n%s\nwant:\n%s", calls, want)
+	}
+}
+
+func TestOpenRCManager(t *testing.T) {
+	callsAbsPath := fakeCommands(t, "exit 0\n", "rc-update", "rc-service")
+	manager := NewOpenRCManager(testAgentService())
+	manager.InitDir = t.TempDir()
+	if status, err := manager.Status(); err != nil || status != ServiceNotInstalled {
+		t.Fatalf("status before install: %v, %v", status, err)
+	}
+	if err := manager.Install(); err != nil {
+		t.Fatal(err)
+	}
+	script, err := os.ReadFile(filepath.Join(manager.InitDir, "zabbix_agentd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"#!/sbin/openrc-run\n", "command=\"/opt/zabbix_agentd/sbin/zabbix_agentd\"\n", "command_args=\"-c /opt/zabbix_agentd/etc/zabbix_agentd.conf -f\"\n", "command_user=\"zabbix\"\n"} {
+		if !strings.Contains(string(script), want) {
+			t.Errorf("service script without %q:\n%s", want, script)
+		}
+	}
+	if status, err := manager.Status(); err != nil || status != ServiceRunning {
+		t.Fatalf("status after install: %v, %v", status, err)
+	}
+	if err = manager.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if !IsFileNotExist(filepath.Join(manager.InitDir, "zabbix_agentd")) {
+		t.Errorf("service script not removed")
+	}
+	calls, _ := os.ReadFile(callsAbsPath)
+	want := "rc-update add zabbix_agentd default\nrc-service zabbix_agentd status\nrc-service zabbix_agentd stop\nrc-update del zabbix_agentd default\n"
+	if string(calls) != want {
+		t.Errorf("calls:\n%s\nwant:\n%s", calls, want)
+	}
+}
+
+func TestUpstartManager(t *testing.T) {
+	callsAbsPath := fakeCommands(t, "[ \"$1\" = status ] && echo \"$2 start/running, process 42\"\nexit 0\n", "initctl")
+	manager := NewUpstartManager(testAgentService())
+	manager.JobDir = t.TempDir()
+	if status, err := manager.Status(); err != nil || status != ServiceNotInstalled {
+		t.Fatalf("status before install: %v, %v", status, err)
+	}
+	if err := manager.Install(); err != nil {
+		t.Fatal(err)
+	}
+	job, err := os.ReadFile(filepath.Join(manager.JobDir, "zabbix_agentd.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(job), "exec su -s /bin/sh -c 'exec \"/opt/zabbix_agentd/sbin/zabbix_agentd\" -c \"/opt/zabbix_agentd/etc/zabbix_agentd.conf\" -f' zabbix\n") {
+		t.Errorf("unexpected job:\n%s", job)
+	}
+	if status, err := manager.Status(); err != nil || status != ServiceRunning {
+		t.Fatalf("status after install: %v, %v", status, err)
+	}
+	if err = manager.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if !IsFileNotExist(filepath.Join(manager.JobDir, "zabbix_agentd.conf")) {
+		t.Errorf("job not removed")
+	}
+	calls, _ := os.ReadFile(callsAbsPath)
+	want := "initctl reload-configuration\ninitctl status zabbix_agentd\ninitctl stop zabbix_agentd\ninitctl reload-configuration\n"
+	if string(calls) != want {
+		t.Errorf("calls:\n%s\nwant:\n%s", calls, want)
+	}
+}
+
+func TestSystemdManagerFindsUnit(t *testing.T) {
+	binDir := t.TempDir()
+	t.Setenv("PATH", binDir)
+	writeFakeCommand(t, binDir, "systemctl", "[ \"$1\" = is-active ] && echo active\nexit 0\n")
+	unitDir := t.TempDir()
+	config := &Config{OSType: "linux", AgentDir: "/opt/proxy", MultipleAgents: true}
+	pathConfig := &PathConfig{}
+	SetAgentPaths(config, pathConfig)
+	manager := NewSystemdManager(NewAgentService(config, pathConfig))
+	manager.UnitDir = unitDir
+	if err := manager.Install(); err != nil {
+		t.Fatal(err)
+	}
+	// an agent whose path contains this one is another agent
+	other := "ExecStart=/home/x" + pathConfig.ZabbixAgentBinAbsPath + " -c /etc/other.conf -f\n"
+	if err := os.WriteFile(filepath.Join(unitDir, "aaa.service"), []byte(other), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config.MultipleAgents = false
+	service := NewAgentService(config, pathConfig)
+	manager = NewSystemdManager(service)
+	manager.UnitDir = unitDir
+	status, err := manager.Status()
+	if err != nil || status != ServiceRunning || service.Name != "zabbix_agentd_proxy" {
+		t.Fatalf("status without -multiple-agents: %v, %s, %v", status, service.Name, err)
+	}
+	if err = manager.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if !IsFileNotExist(filepath.Join(unitDir, "zabbix_agentd_proxy.service")) {
+		t.Errorf("unit not removed")
+	}
+	if IsFileNotExist(filepath.Join(unitDir, "aaa.service")) {
+		t.Errorf("unit of the other agent removed")
+	}
+}
+
+func TestInstallConfigs(t *testing.T) {
+	config := &Config{OSType: "linux", AgentDir: "/opt", ListenPort: "10050", Hostname: "web01", Instances: []string{"t1", "t2"}}
+	if err := instancesHandler(config); err != nil {
+		t.Fatal(err)
+	}
+	configs, err := InstallConfigs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range configs {
+		pathConfig := &PathConfig{}
+		SetAgentPaths(c, pathConfig)
+		got = append(got, strings.Join([]string{c.Hostname, c.ListenPort, pathConfig.ZabbixAgentDirAbsPath, NewAgentService(c, pathConfig).Name}, " "))
+	}
+	want := []string{
+		"web01_t1 10050 /opt/zabbix_agentd_t1 zabbix_agentd_t1",
+		"web01_t2 10051 /opt/zabbix_agentd_t2 zabbix_agentd_t2",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("instances: %v", got)
+	}
+	if config.Instance != "" || config.ListenPort != "10050" {
+		t.Errorf("config changed: %s %s", config.Instance, config.ListenPort)
+	}
+	for _, instances := range [][]string{{"t1", "t1"}, {"a b"}, {"t1", "all"}} {
+		if err := instancesHandler(&Config{OSType: "linux", Instances: instances}); err == nil {
+			t.Errorf("invalid instances accepted: %v", instances)
+		}
+	}
+}
+
+func TestFindInstances(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"zabbix_agentd", "zabbix_agentd_t1", "zabbix_agentd_empty", "other"} {
+		if err := os.MkdirAll(filepath.Join(dir, name, "sbin"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if name != "zabbix_agentd_empty" {
+			writeFakeCommand(t, filepath.Join(dir, name, "sbin"), "zabbix_agentd", "exit 0")
+		}
+	}
+	configs, err := InstanceConfigs(&Config{OSType: "linux", AgentDir: dir, Instances: []string{AllInstances}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range configs {
+		names = append(names, c.Instance)
+	}
+	if strings.Join(names, ",") != ",t1" {
+		t.Errorf("instances: %q", names)
+	}
+}
+
+func TestMoveTree(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range map[string]string{
+		filepath.Join(src, "etc", "zabbix_agentd.conf"): "new",
+		filepath.Join(dst, "etc", "zabbix_agentd.conf"): "old",
+		filepath.Join(dst, "zabbix_agentd.log"):         "log",
+	} {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := MoveTree(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	conf, _ := os.ReadFile(filepath.Join(dst, "etc", "zabbix_agentd.conf"))
+	log, _ := os.ReadFile(filepath.Join(dst, "zabbix_agentd.log"))
+	if string(conf) != "new" || string(log) != "log" {
+		t.Errorf("moved files: %s %s", conf, log)
+	}
+}
+
+func TestWriteConfigTemplate(t *testing.T) {
+	config := &Config{OSType: "linux", AgentDir: t.TempDir(), ServerIP: "fd00::10", ServerPort: "10051", Hostname: "web01", ListenPort: "10050", HostMetadata: "linux"}
+	pathConfig := &PathConfig{}
+	SetAgentPaths(config, pathConfig)
+	if err := writeConfig(config, pathConfig); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := ReadAgentConf(pathConfig.ZabbixAgentConfAbsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"PidFile":      filepath.Join(pathConfig.ZabbixAgentDirAbsPath, "zabbix_agentd.pid"),
+		"Server":       "fd00::10",
+		"ServerActive": "[fd00::10]:10051",
+		"Hostname":     "web01",
+		"HostMetadata": "linux",
+	} {
+		if value, _ := conf.Get(key); value != want {
+			t.Errorf("%s: %s", key, value)
+		}
+	}
+
+	config.Template = filepath.Join(t.TempDir(), "agent.conf.tmpl")
+	tmpl := "Hostname={{.Config.Hostname}}-{{.Var.tenant}}\nHostMetadata={{.Facts.OS}} {{default \"none\" .Var.role}}\n"
+	if err := os.WriteFile(config.Template, []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.TemplateVars = []string{"tenant=acme"}
+	if err := templateHandler(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeConfig(config, pathConfig); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(pathConfig.ZabbixAgentConfAbsPath)
+	if string(data) != "Hostname=web01-acme\nHostMetadata=linux none\n" {
+		t.Errorf("rendered template: %q", data)
+	}
+
+	config.TemplateVars = []string{"tenant"}
+	if err := templateHandler(config); err == nil {
+		t.Errorf("invalid -var accepted")
+	}
+}
+
+func TestWriteScript(t *testing.T) {
+	config := &Config{OSType: "linux", AgentDir: t.TempDir()}
+	pathConfig := &PathConfig{}
+	SetAgentPaths(config, pathConfig)
+	if err := os.MkdirAll(pathConfig.ZabbixAgentDirAbsPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeScript(config, pathConfig); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := RunCommand("sh", "-n", pathConfig.ZabbixAgentAbsPath); err != nil {
+		t.Errorf("script syntax: %s %s", err.Error(), out)
+	}
+	if _, err := RunCommand("sh", pathConfig.ZabbixAgentAbsPath, "status"); err == nil {
+		t.Errorf("status of a stopped agent succeeded")
+	}
+}
+
+func TestDetectCloud(t *testing.T) {
+	for want, dmi := range map[string]map[string]string{
+		"aws":     {"sys_vendor": "Amazon EC2", "product_name": "t3.micro"},
+		"gcp":     {"sys_vendor": "Google", "product_name": "Google Compute Engine"},
+		"azure":   {"sys_vendor": "Microsoft Corporation", "chassis_asset_tag": "7783-7084-3265-9085-8269-3286-77"},
+		"alibaba": {"sys_vendor": "Alibaba Cloud", "product_name": "Alibaba Cloud ECS"},
+		"none":    {"sys_vendor": "Dell Inc.", "product_name": "PowerEdge R640"},
+	} {
+		if cloud := DetectCloud(dmi); cloud != want {
+			t.Errorf("%v: %s, want %s", dmi, cloud, want)
+		}
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "sys_vendor"), []byte("Google\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if dmi := ReadDMI(dir); dmi["sys_vendor"] != "Google" || len(dmi) != 1 {
+		t.Errorf("dmi: %v", dmi)
+	}
+}
+
+func TestComposeHostMetadata(t *testing.T) {
+	config := &Config{
+		OSType:         "linux",
+		OSArch:         "amd64",
+		Tags:           []string{"env=prod", "team = web", "pci"},
+		MetadataFormat: "{{.Facts.OS}}\n{{.Facts.Arch}} {{tags .Facts.Tags}} {{.Facts.Tags.env}}",
+	}
+	if err := metadataHandler(config); err != nil {
+		t.Fatal(err)
+	}
+	if config.HostMetadata != "linux amd64 env=prod pci=true team=web prod" {
+		t.Errorf("HostMetadata: %q", config.HostMetadata)
+	}
+
+	config.MetadataFormat = strings.Repeat("x", maxHostMetadata+1)
+	config.HostMetadata = ""
+	if err := metadataHandler(config); err == nil {
+		t.Errorf("too long HostMetadata accepted")
+	}
+	if err := metadataHandler(&Config{Tags: []string{"=prod"}}); err == nil {
+		t.Errorf("invalid tag accepted")
+	}
+}
+
+func TestTLSPSK(t *testing.T) {
+	config := &Config{OSType: "linux", AgentDir: t.TempDir(), ServerIP: "192.0.2.10", ServerPort: "10051", Hostname: "web01", ListenPort: "10050", TLS: TLSPSK}
+	if err := tlsHandler(config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.TLSPSK) != 2*pskBytes || ValidatePSK(config.TLSPSK) != nil || config.TLSPSKIdentity != "web01" {
+		t.Errorf("generated PSK %s identity %s", config.TLSPSK, config.TLSPSKIdentity)
+	}
+	pathConfig := &PathConfig{}
+	SetAgentPaths(config, pathConfig)
+	if err := writeConfig(config, pathConfig); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := ReadAgentConf(pathConfig.ZabbixAgentConfAbsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"TLSConnect":     "psk",
+		"TLSAccept":      "psk",
+		"TLSPSKIdentity": "web01",
+		"TLSPSKFile":     pathConfig.ZabbixAgentPSKAbsPath,
+	} {
+		if value, _ := conf.Get(key); value != want {
+			t.Errorf("%s: %s", key, value)
+		}
+	}
+	info, err := os.Stat(pathConfig.ZabbixAgentPSKAbsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("PSK file mode: %v", info.Mode())
+	}
+	data, _ := os.ReadFile(pathConfig.ZabbixAgentPSKAbsPath)
+	if string(data) != config.TLSPSK+"\n" {
+		t.Errorf("PSK file: %q", data)
+	}
+	if tls := NewTLSInfo(config, pathConfig); tls.PSK != config.TLSPSK || tls.PSKIdentity != "web01" {
+		t.Errorf("TLS info: %+v", tls)
+	}
+
+	// A reinstall keeps the PSK and the identity the server knows
+	reinstall := &Config{OSType: "linux", AgentDir: config.AgentDir, ServerIP: "192.0.2.10", ServerPort: "10051", Hostname: "web02", ListenPort: "10050", TLS: TLSPSK}
+	if err := tlsHandler(reinstall); err != nil {
+		t.Fatal(err)
+	}
+	local, _, err := readPreviousConf(pathConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reusePSK(reinstall, pathConfig, local); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeConfig(reinstall, pathConfig); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = os.ReadFile(pathConfig.ZabbixAgentPSKAbsPath)
+	if reinstall.TLSPSK != config.TLSPSK || string(data) != config.TLSPSK+"\n" || reinstall.TLSPSKIdentity != "web01" {
+		t.Errorf("reinstall PSK %s identity %s, file %q", reinstall.TLSPSK, reinstall.TLSPSKIdentity, data)
+	}
+	// -tls-psk replaces the key
+	given := &Config{TLS: TLSPSK, TLSPSK: strings.Repeat("cd", 16), Hostname: "web01"}
+	if err := tlsHandler(given); err != nil {
+		t.Fatal(err)
+	}
+	if err := reusePSK(given, pathConfig, local); err != nil || given.TLSPSK != strings.Repeat("cd", 16) {
+		t.Errorf("given PSK replaced by %s: %v", given.TLSPSK, err)
+	}
+
+	for _, psk := range []string{"0123456789abcdef", "xyz", strings.Repeat("ab", 257)} {
+		if err := tlsHandler(&Config{TLS: TLSPSK, TLSPSK: psk, Hostname: "web01"}); err == nil {
+			t.Errorf("invalid PSK accepted: %s", psk)
+		}
+	}
+	given = &Config{TLS: TLSPSK, TLSPSK: strings.Repeat("AB", 16), TLSPSKIdentity: "PSK web"}
+	if err := tlsHandler(given); err != nil || given.TLSPSK != strings.Repeat("ab", 16) || given.TLSPSKIdentity != "PSK web" {
+		t.Errorf("given PSK %s identity %s: %v", given.TLSPSK, given.TLSPSKIdentity, err)
+	}
+}
+
+func TestTLSCert(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{TLS: TLSCert, TLSCAFile: filepath.Join(dir, "ca.crt"), TLSCertFile: filepath.Join(dir, "agent.crt"), TLSKeyFile: filepath.Join(dir, "agent.key")}
+	if err := tlsHandler(config); err == nil {
+		t.Errorf("missing certificate files accepted")
+	}
+	for _, file := range []string{config.TLSCAFile, config.TLSCertFile, config.TLSKeyFile} {
+		if err := os.WriteFile(file, []byte(filepath.Base(file)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tlsHandler(config); err != nil {
+		t.Error(err)
+	}
+	config.OSType, config.AgentDir, config.ServerIP, config.Hostname, config.ListenPort = "linux", t.TempDir(), "192.0.2.10", "web01", "10050"
+	pathConfig := &PathConfig{}
+	SetAgentPaths(config, pathConfig)
+	if err := writeConfig(config, pathConfig); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := ReadAgentConf(pathConfig.ZabbixAgentConfAbsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, file := range map[string]string{
+		"TLSCAFile":   pathConfig.ZabbixAgentTLSCAAbsPath,
+		"TLSCertFile": pathConfig.ZabbixAgentTLSCertAbsPath,
+		"TLSKeyFile":  pathConfig.ZabbixAgentTLSKeyAbsPath,
+	} {
+		if value, _ := conf.Get(key); value != file {
+			t.Errorf("%s: %s", key, value)
+		}
+		info, err := os.Stat(file)
+		if err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("%s copy: %v, %v", key, info, err)
+		}
+	}
+	if data, _ := os.ReadFile(pathConfig.ZabbixAgentTLSKeyAbsPath); string(data) != "agent.key" {
+		t.Errorf("key copy: %q", data)
+	}
+	if err := tlsHandler(&Config{TLS: TLSCert, TLSCAFile: config.TLSCAFile}); err == nil {
+		t.Errorf("-tls cert without -tls-cert accepted")
+	}
+	if err := tlsHandler(&Config{TLS: "ssl"}); err == nil {
+		t.Errorf("invalid -tls accepted")
+	}
+}
+
+// fakeZabbixAPI is a Zabbix API keeping one host in memory
+type fakeZabbixAPI struct {
+	version string
+	token   string
+	calls   []string
+	host    map[string]interface{}
+}
+
+func (f *fakeZabbixAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+		Auth   string          `json:"auth"`
+		ID     int             `json:"id"`
+	}
+	var params map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.Unmarshal(req.Params, &params)
+	f.calls = append(f.calls, req.Method)
+	auth := req.Auth
+	if bearer := r.Header.Get("Authorization"); bearer != "" {
+		auth = strings.TrimPrefix(bearer, "Bearer ")
+	}
+	var result interface{}
+	switch req.Method {
+	case "apiinfo.version":
+		result = f.version
+	case "user.login":
+		result = "session"
+		if params["username"] != "Admin" {
+			result = nil
+		}
+	default:
+		if auth != f.token && auth != "session" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"code": -32602, "message": "Invalid params.", "data": "Not authorized."}, "id": req.ID})
+			return
+		}
+	}
+	switch req.Method {
+	case "hostgroup.get":
+		result = []map[string]string{{"groupid": "2", "name": "Linux servers"}}
+	case "template.get":
+		result = []map[string]string{{"templateid": "10001", "host": "Linux by Zabbix agent"}}
+	case "host.get":
+		hosts := []map[string]interface{}{}
+		if f.host != nil {
+			hosts = append(hosts, map[string]interface{}{
+				"hostid":          "10500",
+				"host":            f.host["host"],
+				"interfaces":      []map[string]string{{"interfaceid": "7", "type": "1", "main": "1"}},
+				"hostgroups":      []map[string]string{{"groupid": "5"}},
+				"parentTemplates": []map[string]string{{"templateid": "10002"}},
+				"macros":          []map[string]string{{"hostmacroid": "3", "macro": "{$SECRET}"}},
+			})
+		}
+		result = hosts
+	case "host.create":
+		f.host = params
+		result = map[string][]string{"hostids": {"10500"}}
+	case "host.update":
+		f.host["groups"], f.host["templates"], f.host["macros"] = params["groups"], params["templates"], params["macros"]
+		result = map[string][]string{"hostids": {"10500"}}
+	case "hostinterface.update", "user.logout":
+		result = true
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "result": result, "id": req.ID})
+}
+
+func TestRegisterHost(t *testing.T) {
+	fake := &fakeZabbixAPI{version: "7.0.0", token: "secret"}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	config := &Config{
+		APIURL: server.URL, APIToken: "secret", Hostname: "web01", AgentIP: "192.0.2.2", ListenPort: "10050",
+		HostGroups: []string{"Linux servers"}, Templates: []string{"Linux by Zabbix agent"}, Macros: []string{"{$ENV}=prod"},
+		TLS: TLSPSK, TLSPSK: strings.Repeat("ab", 16), TLSPSKIdentity: "web01",
+	}
+	if err := apiHandler(config); err != nil {
+		t.Fatal(err)
+	}
+	host, err := registerHost(config, &PathConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !host.Created || host.HostID != "10500" {
+		t.Errorf("created host: %+v", host)
+	}
+	data, _ := json.Marshal(fake.host)
+	for _, want := range []string{`"host":"web01"`, `"ip":"192.0.2.2"`, `"port":"10050"`, `"groupid":"2"`, `"templateid":"10001"`,
+		`{"macro":"{$ENV}","value":"prod"}`, `"tls_connect":2`, `"tls_psk_identity":"web01"`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("host.create params without %s: %s", want, data)
+		}
+	}
+
+	// Registering again updates the host and keeps its groups, templates and macros
+	fake.calls = nil
+	host, err = registerHost(config, &PathConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Created || host.HostID != "10500" {
+		t.Errorf("updated host: %+v", host)
+	}
+	data, _ = json.Marshal([]interface{}{fake.host["groups"], fake.host["templates"], fake.host["macros"]})
+	if string(data) != `[[{"groupid":"5"},{"groupid":"2"}],[{"templateid":"10002"},{"templateid":"10001"}],[{"hostmacroid":"3"},{"macro":"{$ENV}","value":"prod"}]]` {
+		t.Errorf("host.update params: %s", data)
+	}
+	if strings.Join(fake.calls, " ") != "apiinfo.version hostgroup.get template.get host.get host.update hostinterface.update" {
+		t.Errorf("calls: %v", fake.calls)
+	}
+
+	// Zabbix 6.0 with a user, the session is sent in the auth field
+	fake.version, fake.calls = "6.0.20", nil
+	config.APIToken, config.APIUser, config.APIPassword = "", "Admin", "zabbix"
+	if _, err = registerHost(config, &PathConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.calls[1] != "user.login" || fake.calls[len(fake.calls)-1] != "user.logout" {
+		t.Errorf("calls: %v", fake.calls)
+	}
+	config.APIUser = "nobody"
+	if _, err = registerHost(config, &PathConfig{}); err == nil {
+		t.Errorf("failed login accepted")
+	}
+	config.Templates = []string{"Missing template"}
+	config.APIToken = "secret"
+	if _, err = registerHost(config, &PathConfig{}); err == nil || !strings.Contains(err.Error(), "Missing template") {
+		t.Errorf("missing template: %v", err)
+	}
+}
+
+func TestAPIHandler(t *testing.T) {
+	t.Setenv(APITokenEnv, "")
+	t.Setenv(APIPasswordEnv, "")
+	for _, config := range []*Config{
+		{APIURL: "zabbix.example.com", APIToken: "t", HostGroups: []string{"g"}},
+		{APIURL: "https://zabbix.example.com/api_jsonrpc.php", HostGroups: []string{"g"}},
+		{APIURL: "https://zabbix.example.com/api_jsonrpc.php", APIToken: "t"},
+		{APIURL: "https://zabbix.example.com/api_jsonrpc.php", APIToken: "t", HostGroups: []string{"g"}, Macros: []string{"{$env}=x"}},
+	} {
+		if err := apiHandler(config); err == nil {
+			t.Errorf("invalid API options accepted: %+v", config)
+		}
+	}
+	t.Setenv(APITokenEnv, "from-env")
+	config := &Config{APIURL: "https://zabbix.example.com/api_jsonrpc.php", HostGroups: []string{"g"}, Macros: []string{"ENV=prod"}}
+	if err := apiHandler(config); err != nil || config.APIToken != "from-env" {
+		t.Errorf("token %s: %v", config.APIToken, err)
+	}
+	if macros, _ := ParseMacros(config.Macros); macros["{$ENV}"] != "prod" {
+		t.Errorf("macros: %v", macros)
+	}
+}
+
+func TestDeployUserParams(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "app.conf"), []byte("UserParameter=app.ping,%include_dir%/ping.sh\nUserParameter=disk.io[*],echo $1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "ping.sh"), []byte("echo 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{OSType: "linux", AgentDir: t.TempDir(), UserParams: srcDir}
+	if err := userParamsHandler(config); err != nil {
+		t.Fatal(err)
+	}
+	pathConfig := &PathConfig{}
+	SetAgentPaths(config, pathConfig)
+	if err := os.MkdirAll(filepath.Dir(pathConfig.ZabbixAgentBinAbsPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(pathConfig.ZabbixAgentConfAbsPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pathConfig.ZabbixAgentConfAbsPath, []byte("Server=192.0.2.10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Deploying twice adds the Include line once
+	for i := 0; i < 2; i++ {
+		if err := deployUserParams(config, pathConfig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf, _ := ReadAgentConf(pathConfig.ZabbixAgentConfAbsPath)
+	if includes := conf.GetAll("Include"); len(includes) != 1 || includes[0] != filepath.Join(pathConfig.ZabbixAgentIncludeAbsPath, "*.conf") {
+		t.Errorf("Include: %v", includes)
+	}
+	data, _ := os.ReadFile(filepath.Join(pathConfig.ZabbixAgentIncludeAbsPath, "app.conf"))
+	if !strings.Contains(string(data), "UserParameter=app.ping,"+pathConfig.ZabbixAgentIncludeAbsPath+"/ping.sh") {
+		t.Errorf("app.conf:\n%s", data)
+	}
+	for name, mode := range map[string]os.FileMode{"app.conf": 0644, "ping.sh": 0755} {
+		info, err := os.Stat(filepath.Join(pathConfig.ZabbixAgentIncludeAbsPath, name))
+		if err != nil || info.Mode().Perm() != mode {
+			t.Errorf("%s mode: %v, %v", name, info, err)
+		}
+	}
+	keys, err := UserParamKeys(pathConfig.ZabbixAgentIncludeAbsPath)
+	if err != nil || strings.Join(keys, " ") != "app.ping disk.io[*]" {
+		t.Errorf("keys: %v, %v", keys, err)
+	}
+
+	writeFakeCommand(t, filepath.Dir(pathConfig.ZabbixAgentBinAbsPath), "zabbix_agentd", `case "$4" in
+app.ping) echo "app.ping [t|1]" ;;
+*) echo "$4 [m|ZBX_NOTSUPPORTED] [Unsupported item key.]" ;;
+esac
+`)
+	// the flexible disk.io[*] only warns
+	if err := testUserParams(config, pathConfig); err != nil {
+		t.Errorf("test user parameters: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(pathConfig.ZabbixAgentIncludeAbsPath, "app.conf"), []byte("UserParameter=app.ping,echo 1\nUserParameter=app.down,exit 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := testUserParams(config, pathConfig); err == nil || err.Error() != "user parameters not supported: app.down" {
+		t.Errorf("test user parameters: %v", err)
+	}
+
+	bad := filepath.Join(pathConfig.ZabbixAgentIncludeAbsPath, "bad.conf")
+	if err := os.WriteFile(bad, []byte("UserParameter=no.command\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UserParamKeys(pathConfig.ZabbixAgentIncludeAbsPath); err == nil {
+		t.Errorf("UserParameter without command accepted")
+	}
+	if err := userParamsHandler(&Config{UserParams: filepath.Join(srcDir, "ping.sh")}); err == nil {
+		t.Errorf("user parameters file accepted")
+	}
+}
+
+func TestAgentConfValidate(t *testing.T) {
+	conf := ParseAgentConf([]byte("# comment\n\nServer=192.0.2.10\nUserParameter=a,echo a\nUserParameter=b,echo b\nInclude=/etc/zabbix/*.conf\n"))
+	if err := conf.Validate(); err != nil {
+		t.Error(err)
+	}
+	conf = ParseAgentConf([]byte("Server=192.0.2.10\nServre=192.0.2.11\nHostname=a\nHostname=b\nbroken line\n"))
+	err := conf.Validate()
+	want := "invalid configuration: line 2: unknown parameter Servre; line 4: duplicate parameter Hostname; line 5: not Key=Value: broken line"
+	if err == nil || err.Error() != want {
+		t.Errorf("validate: %v", err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := &Config{OSType: "linux", AgentDir: t.TempDir(), ServerIP: "192.0.2.10", ServerPort: "10051", Hostname: "web01", ListenPort: "10050", HostMetadata: "linux", TLS: TLSPSK, TLSPSK: strings.Repeat("ab", 16), TLSPSKIdentity: "web01"}
+	pathConfig := &PathConfig{}
+	SetAgentPaths(config, pathConfig)
+	if err := writeConfig(config, pathConfig); err != nil {
+		t.Fatal(err)
+	}
+	// Without a binary only the parameters are checked
+	if err := validateConfig(pathConfig); err != nil {
+		t.Fatal(err)
+	}
+	binDir := filepath.Dir(pathConfig.ZabbixAgentBinAbsPath)
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	callsAbsPath := filepath.Join(t.TempDir(), "calls")
+	// An agent before 6.0 without -T
+	writeFakeCommand(t, binDir, "zabbix_agentd", `echo "$3" >> `+callsAbsPath+`
+[ "$3" = -T ] && { echo "zabbix_agentd: invalid option -- 'T'" >&2; exit 1; }
+exit 0
+`)
+	if err := validateConfig(pathConfig); err != nil {
+		t.Fatal(err)
+	}
+	if calls, _ := os.ReadFile(callsAbsPath); string(calls) != "-T\n-p\n" {
+		t.Errorf("calls: %q", calls)
+	}
+	writeFakeCommand(t, binDir, "zabbix_agentd", `echo "zabbix_agentd [1]: ERROR: invalid entry \"Timeout=99\" (not following \"parameter=value\" notation)" >&2; exit 1
+`)
+	if err := validateConfig(pathConfig); err == nil || !strings.Contains(err.Error(), "Timeout=99") {
+		t.Errorf("failed test mode: %v", err)
+	}
+}
+
+func TestMergeAgentConf(t *testing.T) {
+	base := ParseAgentConf([]byte("Server=192.0.2.10\nHostname=web01\nLogFileSize=10\nUserParameter=a,echo a\n"))
+	local := ParseAgentConf([]byte("# tuned by ops\nServer=192.0.2.10\nHostname=web01-manual\nLogFileSize=0\nTimeout=10\nUserParameter=a,echo a\nUserParameter=b,echo b\n"))
+	newConf := ParseAgentConf([]byte("Server=192.0.2.20\nHostname=web02\nLogFileSize=10\nUserParameter=a,echo a\n"))
+	merged, conflicts := MergeAgentConf(base, local, newConf)
+	want := "Server=192.0.2.20\nHostname=web02\nLogFileSize=0\nUserParameter=a,echo a\nUserParameter=b,echo b\nTimeout=10\n"
+	if string(merged.Bytes()) != want {
+		t.Errorf("merged:\n%s\nwant:\n%s", merged.Bytes(), want)
+	}
+	if len(conflicts) != 1 || conflicts[0].Key != "Hostname" || conflicts[0].Local[0] != "web01-manual" || conflicts[0].New[0] != "web02" {
+		t.Errorf("conflicts: %+v", conflicts)
+	}
+
+	// Without a base, parameters only set by hand are kept and the others are conflicts
+	merged, conflicts = MergeAgentConf(nil, local, newConf)
+	if value, _ := merged.Get("Timeout"); value != "10" || len(conflicts) != 4 {
+		t.Errorf("merge without base: Timeout=%s, conflicts %+v", value, conflicts)
+	}
+}
+
+func TestInstallMergesConfig(t *testing.T) {
+	config := &Config{OSType: "linux", AgentDir: t.TempDir(), ServerIP: "192.0.2.10", ServerPort: "10051", Hostname: "web01", ListenPort: "10050"}
+	pathConfig := &PathConfig{}
+	SetAgentPaths(config, pathConfig)
+	local, base, err := readPreviousConf(pathConfig)
+	if local != nil || base != nil || err != nil {
+		t.Fatalf("fresh install: %v, %v, %v", local, base, err)
+	}
+	if err := writeConfig(config, pathConfig); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetConfParams(pathConfig.ZabbixAgentConfAbsPath, map[string]string{"Timeout": "10"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Upgrade with another server
+	local, base, err = readPreviousConf(pathConfig)
+	if local == nil || base == nil || err != nil {
+		t.Fatalf("previous config: %v, %v, %v", local, base, err)
+	}
+	config.ServerIP = "192.0.2.20"
+	if err := writeConfig(config, pathConfig); err != nil {
+		t.Fatal(err)
+	}
+	conflicts, err := mergeConfig(config, local, base, pathConfig)
+	if err != nil || len(conflicts) != 0 {
+		t.Fatalf("merge: %v, %v", conflicts, err)
+	}
+	conf, _ := ReadAgentConf(pathConfig.ZabbixAgentConfAbsPath)
+	if server, _ := conf.Get("Server"); server != "192.0.2.20" {
+		t.Errorf("Server: %s", server)
+	}
+	if timeout, _ := conf.Get("Timeout"); timeout != "10" {
+		t.Errorf("Timeout changed by hand is lost: %s", timeout)
+	}
+	base, _ = ReadAgentConf(pathConfig.ZabbixAgentConfBaseAbsPath)
+	if _, ok := base.Get("Timeout"); ok {
+		t.Errorf("base has the change made by hand")
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	config := &Config{OSType: "linux", AgentDir: t.TempDir(), ServerIP: "192.0.2.10", ServerPort: "10051", Hostname: "web01", ListenPort: "10055"}
+	pathConfig := &PathConfig{}
+	SetAgentPaths(config, pathConfig)
+	if err := writeConfig(config, pathConfig); err != nil {
+		t.Fatal(err)
+	}
+	binDir := filepath.Dir(pathConfig.ZabbixAgentBinAbsPath)
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFakeCommand(t, binDir, "zabbix_agentd", "echo 'zabbix_agentd (daemon) (Zabbix) 6.0.13'\n")
+	for name, data := range map[string]string{"zabbix_agentd.log": "log\n", "zabbix_agentd.pid": "42\n"} {
+		if err := os.WriteFile(filepath.Join(pathConfig.ZabbixAgentDirAbsPath, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := backupDir(config)
+	info, err := CreateBackup(config, pathConfig, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "6.0.13" || info.Config.ListenPort != "10055" || info.Size == 0 {
+		t.Errorf("backup: %+v", info)
+	}
+	if _, err := utils.ReadTarGzFile(info.Path, "zabbix_agentd/zabbix_agentd.log"); err == nil {
+		t.Errorf("log file archived without -backup-logs")
+	}
+	if _, err := utils.ReadTarGzFile(info.Path, "zabbix_agentd/zabbix_agentd.pid"); err == nil {
+		t.Errorf("pid file archived")
+	}
+	backups, err := ListBackups(dir)
+	if err != nil || len(backups) != 1 || backups[0].Name != info.Name || backups[0].Config.Hostname != "web01" {
+		t.Fatalf("backups: %v, %v", backups, err)
+	}
+	var out bytes.Buffer
+	PrintBackups(&out, backups)
+	if !strings.Contains(out.String(), info.Name+"  -         6.0.13") {
+		t.Errorf("backup list:\n%s", out.String())
+	}
+
+	// Break the agent and restore the latest backup
+	if err := SetConfParams(pathConfig.ZabbixAgentConfAbsPath, map[string]string{"Server": "192.0.2.99"}); err != nil {
+		t.Fatal(err)
+	}
+	found, err := FindBackup(dir, LatestBackup, "")
+	if err != nil || found.Path != info.Path {
+		t.Fatalf("latest backup: %v, %v", found, err)
+	}
+	if _, err := FindBackup(dir, LatestBackup, "db"); err == nil {
+		t.Errorf("latest backup of another instance found")
+	}
+	if err := RestoreBackupFiles(found, config, pathConfig); err != nil {
+		t.Fatal(err)
+	}
+	conf, _ := ReadAgentConf(pathConfig.ZabbixAgentConfAbsPath)
+	if server, _ := conf.Get("Server"); server != "192.0.2.10" {
+		t.Errorf("restored Server: %s", server)
+	}
+	if version, err := GetAgentVersion(pathConfig.ZabbixAgentBinAbsPath); err != nil || version != "6.0.13" {
+		t.Errorf("restored binary: %s, %v", version, err)
+	}
+	entries, _ := os.ReadDir(config.AgentDir)
+	if len(entries) != 2 || filepath.Base(dir) != "zabbix_agent_installer_backups" {
+		t.Errorf("left in agent dir: %v", entries)
+	}
+	// The conf holds the paths of the agent dir, another -d is refused
+	other := &Config{AgentDir: t.TempDir(), BackupName: info.Path}
+	if err := restore(other, NewResult("restore", other)); GetErrorKind(err) != ValidationError || !strings.Contains(fmt.Sprint(err), "restore it with -d") {
+		t.Errorf("restore into another dir: %v", err)
+	}
+}